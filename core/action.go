@@ -53,15 +53,52 @@ func handleAction(action *Action, result ActionResult) {
 		return
 	case validateConfigMethod:
 		data := []byte(action.Data.(string))
-		result.success(handleValidateConfig(data))
+		result.success(defaultRedactor.Data(handleValidateConfig(data)))
+		return
+	case diagnoseConfigMethod:
+		data := []byte(action.Data.(string))
+		result.success(defaultRedactor.Data(handleDiagnoseConfig(data)))
 		return
 	case updateConfigMethod:
 		data := []byte(action.Data.(string))
-		result.success(handleUpdateConfig(data))
+		result.success(defaultRedactor.Data(handleUpdateConfig(data)))
+		return
+	case patchConfigMethod:
+		data := []byte(action.Data.(string))
+		result.success(defaultRedactor.Data(handlePatchConfig(data)))
 		return
 	case setupConfigMethod:
 		data := []byte(action.Data.(string))
-		result.success(handleSetupConfig(data))
+		result.success(defaultRedactor.Data(handleSetupConfig(data)))
+		return
+	case applyConfigMethod:
+		data := []byte(action.Data.(string))
+		result.success(defaultRedactor.Data(handleApplyConfig(data)))
+		return
+	case setRedactionMethod:
+		paramsString := action.Data.(string)
+		result.success(handleSetRedaction(paramsString))
+		return
+	case getRedactionMethod:
+		result.success(handleGetRedaction())
+		return
+	case exportConfigMethod:
+		paramsString := action.Data.(string)
+		data, err := handleExportConfig(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case getMergedConfigMethod:
+		paramsString, _ := action.Data.(string)
+		data, err := handleGetMergedConfig(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(defaultRedactor.Data(data))
 		return
 	case getProxiesMethod:
 		result.success(handleGetProxies())
@@ -89,7 +126,7 @@ func handleAction(action *Action, result ActionResult) {
 		})
 		return
 	case getConnectionsMethod:
-		result.success(handleGetConnections())
+		result.success(defaultRedactor.Data(handleGetConnections()))
 		return
 	case closeConnectionsMethod:
 		result.success(handleCloseConnections())
@@ -104,7 +141,7 @@ func handleAction(action *Action, result ActionResult) {
 			result.error(err)
 			return
 		}
-		result.success(config)
+		result.success(defaultRedactor.Data(config))
 		return
 	case closeConnectionMethod:
 		id := action.Data.(string)
@@ -118,24 +155,58 @@ func handleAction(action *Action, result ActionResult) {
 		result.success(handleGetExternalProvider(externalProviderName))
 	case updateGeoDataMethod:
 		paramsString := action.Data.(string)
-		var params = map[string]string{}
-		err := json.Unmarshal([]byte(paramsString), &params)
+		var params = &UpdateGeoDataParams{}
+		err := json.Unmarshal([]byte(paramsString), params)
 		if err != nil {
 			result.success(err.Error())
 			return
 		}
-		geoType := params["geo-type"]
-		geoName := params["geo-name"]
-		handleUpdateGeoData(geoType, geoName, func(value string) {
+		handleUpdateGeoData(params, func(value string) {
 			result.success(value)
 		})
 		return
+	case conditionalUpdateGeoDataMethod:
+		paramsString := action.Data.(string)
+		var params = &UpdateGeoDataParams{}
+		err := json.Unmarshal([]byte(paramsString), params)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		handleConditionalUpdateGeoData(params, func(value string) {
+			result.success(value)
+		})
+		return
+	case getGeoDataInventoryMethod:
+		result.success(handleGetGeoDataInventory())
+		return
+	case verifyGeoDataMethod:
+		handleVerifyGeoData(func(value string) {
+			result.success(value)
+		})
+		return
+	case rollbackGeoDataMethod:
+		paramsString := action.Data.(string)
+		var params = &UpdateGeoDataParams{}
+		err := json.Unmarshal([]byte(paramsString), params)
+		if err != nil {
+			result.success(err.Error())
+			return
+		}
+		result.success(handleRollbackGeoData(params))
+		return
 	case updateExternalProviderMethod:
 		providerName := action.Data.(string)
 		handleUpdateExternalProvider(providerName, func(value string) {
 			result.success(value)
 		})
 		return
+	case conditionalUpdateExternalProviderMethod:
+		providerName := action.Data.(string)
+		handleConditionalUpdateExternalProvider(providerName, func(value string) {
+			result.success(value)
+		})
+		return
 	case sideLoadExternalProviderMethod:
 		paramsString := action.Data.(string)
 		var params = map[string]string{}
@@ -158,6 +229,52 @@ func handleAction(action *Action, result ActionResult) {
 		handleStopLog()
 		result.success(true)
 		return
+	case queryLogsMethod:
+		paramsString := action.Data.(string)
+		result.success(defaultRedactor.Data(handleQueryLogs(paramsString)))
+		return
+	case subscribeLogMethod:
+		paramsString := action.Data.(string)
+		result.success(handleSubscribeLog(paramsString))
+		return
+	case unsubscribeLogMethod:
+		id := action.Data.(string)
+		result.success(handleUnsubscribeLog(id))
+		return
+	case setLogFileMethod:
+		paramsString := action.Data.(string)
+		result.success(handleSetLogFile(paramsString))
+		return
+	case createDiagnosticsBundleMethod:
+		result.success(handleCreateDiagnosticsBundle())
+		return
+	case queryDnsMethod:
+		paramsString := action.Data.(string)
+		result.success(defaultRedactor.Data(handleQueryDns(paramsString)))
+		return
+	case subscribeDnsMethod:
+		result.success(handleSubscribeDns())
+		return
+	case unsubscribeDnsMethod:
+		id := action.Data.(string)
+		result.success(handleUnsubscribeDns(id))
+		return
+	case getDnsStatsMethod:
+		result.success(handleGetDnsStats())
+		return
+	case resetFakeIPPoolMethod:
+		result.success(handleResetFakeIPPool())
+		return
+	case benchmarkDnsMethod:
+		paramsString := action.Data.(string)
+		handleBenchmarkDns(paramsString, func(value string, err error) {
+			if err != nil {
+				result.error(err.Error())
+				return
+			}
+			result.success(defaultRedactor.Data(value))
+		})
+		return
 	case startListenerMethod:
 		result.success(handleStartListener())
 		return
@@ -170,6 +287,60 @@ func handleAction(action *Action, result ActionResult) {
 			result.success(value)
 		})
 		return
+	case lookupMethod:
+		query := action.Data.(string)
+		handleLookup(query, func(value string) {
+			result.success(value)
+		})
+		return
+	case explainRuleMethod:
+		paramsString := action.Data.(string)
+		explainResult, err := handleExplainRule(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(explainResult)
+		return
+	case getRuleStatsMethod:
+		paramsString, _ := action.Data.(string)
+		result.success(handleGetRuleStats(paramsString))
+		return
+	case resetRuleStatsMethod:
+		handleResetRuleStats()
+		result.success(true)
+		return
+	case getUnusedRulesMethod:
+		paramsString, _ := action.Data.(string)
+		result.success(handleGetUnusedRules(paramsString))
+		return
+	case insertRuleMethod, overrideRuleMethod:
+		paramsString := action.Data.(string)
+		id, err := handleInsertRule(paramsString, action.Method == overrideRuleMethod)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(id)
+		return
+	case removeRuleMethod:
+		paramsString := action.Data.(string)
+		result.success(handleRemoveRule(paramsString))
+		return
+	case moveRuleMethod:
+		paramsString := action.Data.(string)
+		result.success(handleMoveRule(paramsString))
+		return
+	case getRuleOverlayMethod:
+		result.success(handleGetRuleOverlay())
+		return
+	case deleteRuleOverlayItemMethod:
+		id := action.Data.(string)
+		result.success(handleDeleteRuleOverlayItem(id))
+		return
+	case clearRuleOverlayMethod:
+		result.success(handleClearRuleOverlay())
+		return
 	case getMemoryMethod:
 		handleGetMemory(func(value string) {
 			result.success(value)
@@ -179,6 +350,17 @@ func handleAction(action *Action, result ActionResult) {
 		data := action.Data.(string)
 		handleSetState(data)
 		result.success(true)
+	case updateStateMethod:
+		data := action.Data.(string)
+		result.success(handleUpdateState(data))
+	case getStateMethod:
+		result.success(handleGetState())
+	case startTunListenerMethod:
+		result.success(handleStartTunListener())
+	case stopTunListenerMethod:
+		result.success(handleStopTunListener())
+	case getTunStatusMethod:
+		result.success(handleGetTunStatus())
 	case crashMethod:
 		result.success(true)
 		handleCrash()
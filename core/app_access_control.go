@@ -0,0 +1,116 @@
+package main
+
+import (
+	"core/state"
+	"errors"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// appRuleLines returns the rules enforcing accessControl as config lines,
+// none when it is disabled or the platform routes apps by itself. The apps
+// left out go DIRECT, the others fall through to the rules or, with a proxy
+// set, are forced through it.
+func appRuleLines(accessControl *state.AccessControl) []string {
+	if runtime.GOOS != "linux" || accessControl == nil || !accessControl.Enable {
+		return []string{}
+	}
+	entries := accessControl.RejectList
+	if accessControl.Mode == state.AcceptSelectedMode {
+		entries = accessControl.AcceptList
+	}
+	conditions := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case strings.ContainsAny(entry, ",()"):
+			log.Warnln("[Rule] skip app %s of access control", entry)
+			continue
+		}
+		if _, err := strconv.ParseUint(entry, 10, 32); err == nil {
+			conditions = append(conditions, "(UID,"+entry+")")
+		} else if filepath.IsAbs(entry) {
+			conditions = append(conditions, "(PROCESS-PATH,"+entry+")")
+		} else {
+			conditions = append(conditions, "(PROCESS-NAME,"+entry+")")
+		}
+	}
+	selected := "(OR,(" + strings.Join(conditions, ",") + "))"
+	lines := []string{}
+	switch {
+	case accessControl.Mode == state.AcceptSelectedMode && len(conditions) == 0:
+		return []string{"IN-TYPE,TUN,DIRECT"}
+	case accessControl.Mode == state.AcceptSelectedMode:
+		lines = append(lines, "AND,((IN-TYPE,TUN),(NOT,("+selected+"))),DIRECT")
+	case len(conditions) > 0:
+		lines = append(lines, "AND,((IN-TYPE,TUN),"+selected+"),DIRECT")
+	}
+	if accessControl.Proxy != "" {
+		lines = append(lines, "IN-TYPE,TUN,"+accessControl.Proxy)
+	}
+	return lines
+}
+
+// appRule matches a rule enforcing access control, the uid of tun
+// connections is looked up in procfs when find-process-mode is off, as
+// mihomo leaves the process of the metadata unset then.
+type appRule struct {
+	constant.Rule
+}
+
+func (r *appRule) Match(metadata *constant.Metadata) (bool, string) {
+	if metadata.Type == constant.TUN && tunnel.FindProcessMode().Off() {
+		if uid, ok := querySocketUid(metadata); ok {
+			metadata.Uid = uid
+		}
+	}
+	return r.Rule.Match(metadata)
+}
+
+// validateAppAccessControl refuses process names and paths while
+// find-process-mode is off, only uids are looked up then.
+func validateAppAccessControl(accessControl *state.AccessControl) error {
+	if !tunnel.FindProcessMode().Off() {
+		return nil
+	}
+	for _, line := range appRuleLines(accessControl) {
+		if strings.Contains(line, "(PROCESS-") {
+			return errors.New("app-access-control: process names and paths need find-process-mode, it is off")
+		}
+	}
+	return nil
+}
+
+// appRules parses the rules enforcing accessControl. A forced proxy that is
+// missing rejects the connections instead of letting them fall through to
+// the rules.
+func appRules(accessControl *state.AccessControl) []constant.Rule {
+	if err := validateAppAccessControl(accessControl); err != nil {
+		log.Errorln("[Rule] %v, only uids are matched", err)
+	}
+	lines := appRuleLines(accessControl)
+	rules := make([]constant.Rule, 0, len(lines))
+	for index, line := range lines {
+		rule, err := parseRuleLine(line)
+		if err != nil && index == len(lines)-1 && accessControl.Proxy != "" {
+			log.Warnln("[Rule] proxy %s of access control not available, reject instead: %v", accessControl.Proxy, err)
+			rule, err = parseRuleLine("IN-TYPE,TUN,REJECT")
+		}
+		if err != nil {
+			log.Warnln("[Rule] skip access control rule %s: %v", line, err)
+			continue
+		}
+		if rule.ShouldFindProcess() {
+			rule = &appRule{Rule: rule}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
@@ -0,0 +1,28 @@
+//go:build linux
+
+package main
+
+import (
+	"core/platform"
+	"github.com/metacubex/mihomo/constant"
+	"net"
+)
+
+// querySocketUid looks up the uid owning the source socket of metadata in
+// procfs.
+func querySocketUid(metadata *constant.Metadata) (uint32, bool) {
+	var source net.Addr
+	switch metadata.NetWork {
+	case constant.TCP:
+		source = &net.TCPAddr{IP: metadata.SrcIP.AsSlice(), Port: int(metadata.SrcPort)}
+	case constant.UDP:
+		source = &net.UDPAddr{IP: metadata.SrcIP.AsSlice(), Port: int(metadata.SrcPort)}
+	default:
+		return 0, false
+	}
+	uid := platform.QuerySocketUidFromProcFs(source, nil)
+	if uid < 0 {
+		return 0, false
+	}
+	return uint32(uid), true
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "github.com/metacubex/mihomo/constant"
+
+func querySocketUid(_ *constant.Metadata) (uint32, bool) {
+	return 0, false
+}
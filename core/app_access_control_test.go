@@ -0,0 +1,263 @@
+//go:build linux
+
+package main
+
+import (
+	"core/state"
+	"encoding/json"
+	"github.com/metacubex/mihomo/component/process"
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/tunnel"
+	"net"
+	"net/netip"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestAppRuleLines(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		accessControl *state.AccessControl
+		lines         []string
+	}{
+		{"nil", nil, []string{}},
+		{"disabled", &state.AccessControl{Mode: state.AcceptSelectedMode, AcceptList: []string{"curl"}}, []string{}},
+		{
+			"accept",
+			&state.AccessControl{Enable: true, Mode: state.AcceptSelectedMode, AcceptList: []string{"1000", "/usr/bin/curl", "firefox", "bad,name"}},
+			[]string{"AND,((IN-TYPE,TUN),(NOT,((OR,((UID,1000),(PROCESS-PATH,/usr/bin/curl),(PROCESS-NAME,firefox)))))),DIRECT"},
+		},
+		{
+			"accept none",
+			&state.AccessControl{Enable: true, Mode: state.AcceptSelectedMode, Proxy: "proxy"},
+			[]string{"IN-TYPE,TUN,DIRECT"},
+		},
+		{
+			"accept with proxy",
+			&state.AccessControl{Enable: true, Mode: state.AcceptSelectedMode, AcceptList: []string{"firefox"}, Proxy: "proxy"},
+			[]string{"AND,((IN-TYPE,TUN),(NOT,((OR,((PROCESS-NAME,firefox)))))),DIRECT", "IN-TYPE,TUN,proxy"},
+		},
+		{
+			"reject",
+			&state.AccessControl{Enable: true, Mode: state.RejectSelectedMode, RejectList: []string{"1000"}},
+			[]string{"AND,((IN-TYPE,TUN),(OR,((UID,1000)))),DIRECT"},
+		},
+		{"reject none", &state.AccessControl{Enable: true, Mode: state.RejectSelectedMode}, []string{}},
+		{
+			"reject with proxy",
+			&state.AccessControl{Enable: true, Mode: state.RejectSelectedMode, RejectList: []string{"curl"}, Proxy: "proxy"},
+			[]string{"AND,((IN-TYPE,TUN),(OR,((PROCESS-NAME,curl)))),DIRECT", "IN-TYPE,TUN,proxy"},
+		},
+	} {
+		if lines := appRuleLines(test.accessControl); !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s: got %v, want %v", test.name, lines, test.lines)
+		}
+	}
+}
+
+func setAppAccessControl(t *testing.T, accessControl *state.AccessControl) {
+	t.Helper()
+	data, err := json.Marshal(map[string]any{"app-access-control": accessControl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = updateState(string(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type explainCase struct {
+	inboundType   string
+	process       string
+	uid           uint32
+	host          string
+	proxy         string
+	index         int
+	accessControl bool
+}
+
+func checkExplain(t *testing.T, tests []explainCase) {
+	t.Helper()
+	for _, test := range tests {
+		uid := test.uid
+		result, err := explainRule(&ExplainRuleParams{
+			Host:        test.host,
+			DstPort:     443,
+			InboundType: test.inboundType,
+			Process:     test.process,
+			Uid:         &uid,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Proxy != test.proxy || result.Index != test.index || result.AccessControl != test.accessControl {
+			t.Errorf("%+v: got %s at %d, access control %v", test, result.Proxy, result.Index, result.AccessControl)
+		}
+	}
+}
+
+func TestAppRulesAcceptSelected(t *testing.T) {
+	setupRuleTest(t, "DOMAIN,example.com,REJECT", "MATCH,proxy")
+	setAppAccessControl(t, &state.AccessControl{
+		Enable:     true,
+		Mode:       state.AcceptSelectedMode,
+		AcceptList: []string{"firefox", "1000"},
+	})
+	checkExplain(t, []explainCase{
+		{"TUN", "curl", 0, "example.org", "DIRECT", -1, true},
+		{"TUN", "firefox", 0, "example.com", "REJECT", 0, false},
+		{"TUN", "curl", 1000, "example.org", "proxy", 1, false},
+		{"HTTP", "curl", 0, "example.org", "proxy", 1, false},
+	})
+
+	runLock.Lock()
+	defer runLock.Unlock()
+	if appRuleCount != 1 || len(tunnel.Rules()) != 3 {
+		t.Fatalf("%d access control rules in %d rules", appRuleCount, len(tunnel.Rules()))
+	}
+	if rule := tunnel.Rules()[0]; rule.RuleType() != constant.AND || !rule.ShouldFindProcess() {
+		t.Fatalf("unexpected access control rule %s %s", rule.RuleType(), rule.Payload())
+	}
+	stats := getRuleStats(&RuleStatsParams{})
+	if len(stats) != 2 || stats[0].Payload != "example.com" || stats[1].Index != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if report := getUnusedRules(&UnusedRulesParams{}); len(report.Rules) != 2 {
+		t.Fatalf("unexpected unused rules %+v", report.Rules)
+	}
+	if err := moveRule(&MoveRuleParams{From: 1, To: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if rules := profileRules(); rules[0].RuleType() != constant.MATCH || tunnel.Rules()[0].RuleType() != constant.AND {
+		t.Fatal("move did not keep the access control rule ahead")
+	}
+	if err := removeRule(&RemoveRuleParams{Index: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if rules := profileRules(); len(rules) != 1 || rules[0].RuleType() != constant.MATCH {
+		t.Fatalf("remove took the wrong rule, left %d rules", len(rules))
+	}
+	if _, err := insertRule(&InsertRuleParams{Rule: "DOMAIN,example.net,DIRECT", Index: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if rules := profileRules(); len(rules) != 2 || rules[0].Payload() != "example.net" || tunnel.Rules()[0].RuleType() != constant.AND {
+		t.Fatal("insert did not land at the profile index")
+	}
+}
+
+func TestAppRulesForcedProxy(t *testing.T) {
+	setupRuleTest(t, "MATCH,DIRECT")
+	setAppAccessControl(t, &state.AccessControl{
+		Enable:     true,
+		Mode:       state.RejectSelectedMode,
+		RejectList: []string{"curl"},
+		Proxy:      "proxy",
+	})
+	checkExplain(t, []explainCase{
+		{"TUN", "firefox", 0, "example.org", "proxy", -1, true},
+		{"TUN", "curl", 0, "example.org", "DIRECT", -1, true},
+		{"HTTP", "firefox", 0, "example.org", "DIRECT", 0, false},
+	})
+
+	// a config without the forced proxy must not leak the apps to the rules
+	cfg, err := config.ParseRawConfig(defaultSetupParams().Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runLock.Lock()
+	tunnel.UpdateProxies(cfg.Proxies, cfg.Providers)
+	applyRuleOverlay()
+	runLock.Unlock()
+	checkExplain(t, []explainCase{
+		{"TUN", "firefox", 0, "example.org", "REJECT", -1, true},
+	})
+
+	data, _ := json.Marshal(map[string]any{"app-access-control": &state.AccessControl{
+		Enable: true,
+		Mode:   state.RejectSelectedMode,
+		Proxy:  "missing",
+	}})
+	if err := updateState(string(data)); err == nil {
+		t.Fatal("expected a missing proxy to be rejected")
+	}
+}
+
+// dialTestSocket connects to a loopback listener from a socket owned by a
+// uid other than root, which UID rules never match, and returns its port and
+// uid.
+func dialTestSocket(t *testing.T) (uint16, uint32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	uid := uint32(os.Getuid())
+	if uid == 0 {
+		// sockets are owned by the fsuid of the thread creating them
+		uid = 65534
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		if err = syscall.Setfsuid(int(uid)); err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Setfsuid(0)
+	}
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return uint16(conn.LocalAddr().(*net.TCPAddr).Port), uid
+}
+
+func TestAppRulesFindProcessOff(t *testing.T) {
+	setupRuleTest(t, "MATCH,DIRECT")
+	tunnel.SetFindProcessMode(process.FindProcessOff)
+	defer tunnel.SetFindProcessMode(process.FindProcessStrict)
+	port, uid := dialTestSocket(t)
+	for _, test := range []struct {
+		acceptList []string
+		direct     bool
+	}{
+		{[]string{strconv.FormatUint(uint64(uid), 10)}, false},
+		{[]string{strconv.FormatUint(uint64(uid)+1, 10)}, true},
+	} {
+		rules := appRules(&state.AccessControl{Enable: true, Mode: state.AcceptSelectedMode, AcceptList: test.acceptList})
+		if len(rules) != 1 {
+			t.Fatalf("%v: %d access control rules with find-process-mode off", test.acceptList, len(rules))
+		}
+		metadata := &constant.Metadata{
+			Type:    constant.TUN,
+			NetWork: constant.TCP,
+			SrcIP:   netip.MustParseAddr("127.0.0.1"),
+			SrcPort: port,
+			DstIP:   netip.MustParseAddr("192.0.2.1"),
+			DstPort: 443,
+		}
+		if matched, _ := rules[0].Match(metadata); matched != test.direct {
+			t.Errorf("%v: direct = %v, want %v", test.acceptList, matched, test.direct)
+		}
+		if metadata.Uid != uid {
+			t.Errorf("%v: uid = %d, want %d from procfs", test.acceptList, metadata.Uid, uid)
+		}
+	}
+
+	data, _ := json.Marshal(map[string]any{"app-access-control": &state.AccessControl{
+		Enable:     true,
+		Mode:       state.AcceptSelectedMode,
+		AcceptList: []string{"firefox"},
+	}})
+	if err := updateState(string(data)); err == nil {
+		t.Fatal("process names passed with find-process-mode off")
+	}
+}
@@ -5,33 +5,39 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/metacubex/mihomo/adapter"
 	"github.com/metacubex/mihomo/adapter/inbound"
 	"github.com/metacubex/mihomo/adapter/outboundgroup"
 	"github.com/metacubex/mihomo/adapter/provider"
 	"github.com/metacubex/mihomo/common/batch"
 	"github.com/metacubex/mihomo/component/dialer"
+	mihomoHttp "github.com/metacubex/mihomo/component/http"
 	"github.com/metacubex/mihomo/component/resolver"
 	"github.com/metacubex/mihomo/config"
 	"github.com/metacubex/mihomo/constant"
 	"github.com/metacubex/mihomo/constant/features"
 	cp "github.com/metacubex/mihomo/constant/provider"
-	"github.com/metacubex/mihomo/hub"
 	"github.com/metacubex/mihomo/hub/route"
 	"github.com/metacubex/mihomo/listener"
 	"github.com/metacubex/mihomo/log"
 	rp "github.com/metacubex/mihomo/rules/provider"
 	"github.com/metacubex/mihomo/tunnel"
+	"net/http"
 	"os"
 	"sync"
+	"time"
 )
 
+const defaultProbeTimeout = time.Second * 5
+
 var (
-	currentConfig *config.Config
-	version       = 0
-	isRunning     = false
-	runLock       sync.Mutex
-	mBatch, _     = batch.New[bool](context.Background(), batch.WithConcurrencyNum[bool](50))
+	currentConfig       *config.Config
+	lastGoodSetupParams *SetupParams
+	version             = 0
+	isRunning           = false
+	runLock             sync.Mutex
+	mBatch, _           = batch.New[bool](context.Background(), batch.WithConcurrencyNum[bool](50))
 )
 
 type ExternalProviders []ExternalProvider
@@ -128,7 +134,7 @@ func updateListeners() {
 	listener.ReCreateVmess(general.VmessConfig, tunnel.Tunnel)
 	listener.ReCreateTuic(general.TuicServer, tunnel.Tunnel)
 	if !features.Android {
-		listener.ReCreateTun(general.Tun, tunnel.Tunnel)
+		updateTun()
 	}
 }
 
@@ -157,6 +163,20 @@ func patchSelectGroup(mapping map[string]string) {
 	}
 }
 
+// patchLastGoodConfig applies patch to a copy of the last applied raw config,
+// the lock must be held.
+func patchLastGoodConfig(patch func(raw *config.RawConfig)) {
+	setup := lastGoodSetupParams
+	if setup == nil {
+		setup = defaultSetupParams()
+	}
+	raw := *setup.Config
+	patch(&raw)
+	saved := *setup
+	saved.Config = &raw
+	lastGoodSetupParams = &saved
+}
+
 func defaultSetupParams() *SetupParams {
 	return &SetupParams{
 		Config:      config.DefaultRawConfig(),
@@ -177,77 +197,283 @@ func readFile(path string) ([]byte, error) {
 	return data, err
 }
 
-func updateConfig(params *UpdateParams) {
+func updateConfig(params *UpdateParams) []*UpdateFieldResult {
 	runLock.Lock()
 	defer runLock.Unlock()
+	results := []*UpdateFieldResult{}
+	record := func(field string, err error) {
+		result := &UpdateFieldResult{
+			Field:   field,
+			Success: err == nil,
+		}
+		if err != nil {
+			log.Errorln("[Config] update %s error: %v", field, err)
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	if currentConfig == nil {
+		record("config", errors.New("config not applied"))
+		return results
+	}
+	// the running config no longer matches its raw config, so the next
+	// setup has to reload everything.
+	currentRawConfig = nil
 	general := currentConfig.General
 	if params.MixedPort != nil {
 		general.MixedPort = *params.MixedPort
 	}
+	if params.Port != nil {
+		general.Port = *params.Port
+	}
+	if params.SocksPort != nil {
+		general.SocksPort = *params.SocksPort
+	}
+	if params.RedirPort != nil {
+		general.RedirPort = *params.RedirPort
+	}
+	if params.TProxyPort != nil {
+		general.TProxyPort = *params.TProxyPort
+	}
+	if params.AllowLan != nil {
+		general.AllowLan = *params.AllowLan
+		record("allow-lan", nil)
+	}
 	if params.Sniffing != nil {
 		general.Sniffing = *params.Sniffing
 		tunnel.SetSniffing(general.Sniffing)
+		record("sniffing", nil)
 	}
 	if params.FindProcessMode != nil {
 		general.FindProcessMode = *params.FindProcessMode
 		tunnel.SetFindProcessMode(general.FindProcessMode)
+		// the access control rules depend on it
+		applyRuleOverlay()
+		record("find-process-mode", nil)
 	}
 	if params.TCPConcurrent != nil {
 		general.TCPConcurrent = *params.TCPConcurrent
 		dialer.SetTcpConcurrent(general.TCPConcurrent)
+		record("tcp-concurrent", nil)
 	}
 	if params.Interface != nil {
 		general.Interface = *params.Interface
 		dialer.DefaultInterface.Store(general.Interface)
+		record("interface-name", nil)
 	}
 	if params.UnifiedDelay != nil {
 		general.UnifiedDelay = *params.UnifiedDelay
 		adapter.UnifiedDelay.Store(general.UnifiedDelay)
+		record("unified-delay", nil)
 	}
 	if params.Mode != nil {
 		general.Mode = *params.Mode
 		tunnel.SetMode(general.Mode)
+		record("mode", nil)
 	}
 	if params.LogLevel != nil {
 		general.LogLevel = *params.LogLevel
 		log.SetLevel(general.LogLevel)
+		record("log-level", nil)
 	}
 	if params.IPv6 != nil {
 		general.IPv6 = *params.IPv6
 		resolver.DisableIPv6 = !general.IPv6
+		record("ipv6", nil)
 	}
 	if params.ExternalController != nil {
 		currentConfig.Controller.ExternalController = *params.ExternalController
 		route.ReCreateServer(&route.Config{
 			Addr: currentConfig.Controller.ExternalController,
 		})
+		record("external-controller", nil)
 	}
 
+	tunApplied := false
 	if params.Tun != nil {
-		general.Tun.Enable = params.Tun.Enable
-		general.Tun.AutoRoute = *params.Tun.AutoRoute
-		general.Tun.Device = *params.Tun.Device
-		general.Tun.RouteAddress = *params.Tun.RouteAddress
-		general.Tun.DNSHijack = *params.Tun.DNSHijack
-		general.Tun.Stack = *params.Tun.Stack
+		tun := general.Tun
+		params.Tun.patch(&tun)
+		err := validateTun(&tun)
+		if err == nil {
+			general.Tun = tun
+			tunApplied = true
+		}
+		record("tun", err)
 	}
 
+	// every applied field goes into the raw config, so a later reload or
+	// rollback keeps it
+	patchLastGoodConfig(func(raw *config.RawConfig) {
+		patchGeneral(params, raw, tunApplied)
+		updateConfigSections(params, raw, record)
+	})
 	updateListeners()
+	checkPortFields(params, record)
+	return results
+}
+
+func applyConfig(cfg *config.Config, params *SetupParams) []string {
+	constant.DefaultTestURL = params.TestURL
+	sections := reloadConfig(cfg, params.Config)
+	reloadRuleOverlay()
+	patchSelectGroup(params.SelectedMap)
+	for _, section := range sections {
+		if section == AllSection || section == ListenersSection {
+			updateListeners()
+			break
+		}
+	}
+	return sections
+}
+
+func checkListeners() error {
+	if !isRunning || currentConfig == nil {
+		return nil
+	}
+	general := currentConfig.General
+	ports := listener.GetPorts()
+	expected := map[string][2]int{
+		"port":        {general.Port, ports.Port},
+		"socks-port":  {general.SocksPort, ports.SocksPort},
+		"redir-port":  {general.RedirPort, ports.RedirPort},
+		"tproxy-port": {general.TProxyPort, ports.TProxyPort},
+		"mixed-port":  {general.MixedPort, ports.MixedPort},
+	}
+	for name, port := range expected {
+		if port[0] != 0 && port[1] == 0 {
+			return fmt.Errorf("%s %d bind failed", name, port[0])
+		}
+	}
+	return nil
 }
 
-func setupConfig(params *SetupParams) error {
+func probeConfig(params *SetupParams) *ProbeResult {
+	probe := &ProbeResult{
+		Url: params.TestURL,
+	}
+	timeout := time.Millisecond * time.Duration(params.ProbeTimeout)
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	resp, err := mihomoHttp.HttpRequest(ctx, params.TestURL, http.MethodHead, nil, nil)
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		probe.Error = resp.Status
+		return probe
+	}
+	probe.Delay = time.Since(start).Milliseconds()
+	return probe
+}
+
+// rollbackConfig restores the last config that was applied successfully,
+// or the default config when nothing has been applied yet.
+func rollbackConfig() {
+	params := lastGoodSetupParams
+	if params == nil {
+		params = defaultSetupParams()
+	}
+	cfg, err := config.ParseRawConfig(params.Config)
+	if err != nil {
+		log.Errorln("[Config] rollback error: %v", err)
+		params = defaultSetupParams()
+		cfg, _ = config.ParseRawConfig(params.Config)
+	}
+	applyConfig(cfg, params)
+}
+
+var errConfigSuperseded = errors.New("config replaced while probing")
+
+// rollbackIfUnset falls back to the last good config when nothing runs yet,
+// a running config is left as it is.
+func rollbackIfUnset(result *SetupResult) {
+	if currentConfig != nil {
+		return
+	}
+	rollbackConfig()
+	result.RolledBack = true
+}
+
+// setupConfig applies params as a transaction, the running config is only
+// replaced when the new one parses, binds its listeners and passes the probe.
+func setupConfig(params *SetupParams) *SetupResult {
 	runLock.Lock()
 	defer runLock.Unlock()
-	var err error
-	constant.DefaultTestURL = params.TestURL
-	currentConfig, err = config.ParseRawConfig(params.Config)
+	start := time.Now()
+	result := &SetupResult{}
+	// the caller's params keep the config it passed in
+	applied := *params
+	params = &applied
+	fail := func(stage SetupStage, err error) *SetupResult {
+		log.Errorln("[Config] setup %s error: %v", stage, err)
+		result.Stage = stage
+		result.Error = err.Error()
+		result.Duration = time.Since(start).Milliseconds()
+		return result
+	}
+	if len(params.Overrides) > 0 {
+		merged, err := mergeConfig(params.Config, params.Overrides)
+		if err != nil {
+			rollbackIfUnset(result)
+			return fail(ParseSetupStage, err)
+		}
+		params.Config = merged
+	}
+	params.merged = params.Config
+	if params.Script != "" {
+		timeout := time.Millisecond * time.Duration(params.ScriptTimeout)
+		transformed, err := runConfigScript(params.Script, params.Config, timeout)
+		if err != nil {
+			var e *scriptError
+			if errors.As(err, &e) {
+				result.Diagnostics = []*Diagnostic{e.diagnostic}
+			}
+			rollbackIfUnset(result)
+			return fail(ScriptSetupStage, err)
+		}
+		params.Config = transformed
+	}
+	cfg, err := config.ParseRawConfig(params.Config)
 	if err != nil {
-		currentConfig, _ = config.ParseRawConfig(config.DefaultRawConfig())
+		rollbackIfUnset(result)
+		return fail(ParseSetupStage, err)
 	}
-	hub.ApplyConfig(currentConfig)
-	patchSelectGroup(params.SelectedMap)
-	updateListeners()
-	return err
+	result.Reloaded = applyConfig(cfg, params)
+	if err = checkListeners(); err != nil {
+		rollbackConfig()
+		result.RolledBack = true
+		return fail(ListenSetupStage, err)
+	}
+	if params.Probe {
+		// the probe may take its whole timeout, other actions go on meanwhile
+		applied := currentConfig
+		runLock.Unlock()
+		result.Probe = probeConfig(params)
+		runLock.Lock()
+		if currentConfig != applied {
+			return fail(ProbeSetupStage, errConfigSuperseded)
+		}
+		if result.Probe.Error != "" {
+			rollbackConfig()
+			result.RolledBack = true
+			return fail(ProbeSetupStage, errors.New(result.Probe.Error))
+		}
+	}
+	lastGoodSetupParams = params
+	result.Applied = true
+	result.Proxies = len(currentConfig.Proxies)
+	result.Providers = len(currentConfig.Providers)
+	result.Rules = len(profileRules())
+	result.RuleProviders = len(currentConfig.RuleProviders)
+	result.Ports = listener.GetPorts()
+	result.Duration = time.Since(start).Milliseconds()
+	return result
 }
 
 func UnmarshalJson(data []byte, v any) error {
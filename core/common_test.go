@@ -0,0 +1,135 @@
+package main
+
+import (
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/tunnel"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testSetupParams returns params with a socks proxy named after proxy that
+// every rule sends to.
+func testSetupParams(proxy string, rule string) *SetupParams {
+	params := defaultSetupParams()
+	params.Config.Proxy = []map[string]any{
+		{"name": proxy, "type": "socks5", "server": "127.0.0.1", "port": 1080},
+	}
+	params.Config.Rule = []string{rule}
+	return params
+}
+
+func resetSetupTest(t *testing.T) {
+	t.Helper()
+	useTestHomeDir(t)
+	t.Cleanup(func() {
+		runLock.Lock()
+		defer runLock.Unlock()
+		stopListeners()
+		isRunning = false
+		currentConfig = nil
+		currentRawConfig = nil
+		lastGoodSetupParams = nil
+		tunnel.UpdateRules(nil, nil, nil)
+		tunnel.SetMode(tunnel.Rule)
+	})
+}
+
+func runningProxy(name string) bool {
+	runLock.Lock()
+	defer runLock.Unlock()
+	_, ok := tunnel.Proxies()[name]
+	return ok
+}
+
+func TestSetupConfigParseFailure(t *testing.T) {
+	resetSetupTest(t)
+
+	// nothing runs yet, so the default config is applied
+	result := setupConfig(testSetupParams("first", "MATCH,missing"))
+	if result.Applied || !result.RolledBack || result.Stage != ParseSetupStage || currentConfig == nil {
+		t.Fatalf("first setup = %+v", result)
+	}
+
+	if result = setupConfig(testSetupParams("good", "MATCH,good")); !result.Applied || result.Proxies == 0 || result.Rules != 1 {
+		t.Fatalf("good setup = %+v", result)
+	}
+	// a running config is kept as it is
+	result = setupConfig(testSetupParams("bad", "MATCH,missing"))
+	if result.Applied || result.RolledBack || result.Stage != ParseSetupStage || result.Error == "" {
+		t.Fatalf("bad setup = %+v", result)
+	}
+	if !runningProxy("good") || runningProxy("bad") {
+		t.Fatal("a config that failed to parse replaced the running one")
+	}
+}
+
+func TestSetupConfigListenFailure(t *testing.T) {
+	resetSetupTest(t)
+	if result := setupConfig(testSetupParams("good", "MATCH,good")); !result.Applied {
+		t.Fatalf("good setup = %+v", result)
+	}
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	runLock.Lock()
+	isRunning = true
+	runLock.Unlock()
+
+	params := testSetupParams("bound", "MATCH,bound")
+	params.Config.MixedPort = busy.Addr().(*net.TCPAddr).Port
+	result := setupConfig(params)
+	if result.Applied || !result.RolledBack || result.Stage != ListenSetupStage {
+		t.Fatalf("setup on a busy port = %+v", result)
+	}
+	if !runningProxy("good") || runningProxy("bound") || currentConfig.General.MixedPort != 0 {
+		t.Fatal("the config was not rolled back after the bind failure")
+	}
+}
+
+func TestSetupConfigProbeFailure(t *testing.T) {
+	resetSetupTest(t)
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	// the probe goes through the tunnel
+	probed := func(proxy string) *SetupParams {
+		params := testSetupParams(proxy, "MATCH,DIRECT")
+		params.TestURL = server.URL
+		params.Probe = true
+		return params
+	}
+
+	result := setupConfig(probed("good"))
+	if !result.Applied || result.Probe == nil || result.Probe.Error != "" {
+		t.Fatalf("probed setup = %+v", result)
+	}
+	status = http.StatusBadGateway
+	result = setupConfig(probed("unreachable"))
+	if result.Applied || !result.RolledBack || result.Stage != ProbeSetupStage || result.Probe == nil || result.Probe.Error == "" {
+		t.Fatalf("setup failing the probe = %+v", result)
+	}
+	if !runningProxy("good") || runningProxy("unreachable") {
+		t.Fatal("the config was not rolled back after the probe failed")
+	}
+	if lastGoodSetupParams == nil || lastGoodSetupParams.Config.Proxy[0]["name"] != "good" {
+		t.Fatal("the failed config became the last good one")
+	}
+}
+
+func TestPatchLastGoodConfig(t *testing.T) {
+	resetSetupTest(t)
+	params := testSetupParams("good", "MATCH,good")
+	lastGoodSetupParams = params
+	patchLastGoodConfig(func(raw *config.RawConfig) {
+		raw.MixedPort = 7890
+	})
+	if lastGoodSetupParams.Config.MixedPort != 7890 || params.Config.MixedPort != 0 {
+		t.Fatal("patchLastGoodConfig changed the applied params in place")
+	}
+}
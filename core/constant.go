@@ -6,6 +6,7 @@ import (
 	P "github.com/metacubex/mihomo/component/process"
 	"github.com/metacubex/mihomo/config"
 	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/listener"
 	"github.com/metacubex/mihomo/log"
 	"github.com/metacubex/mihomo/tunnel"
 	"net/netip"
@@ -18,9 +19,48 @@ type InitParams struct {
 }
 
 type SetupParams struct {
-	Config      *config.RawConfig `json:"config"`
-	SelectedMap map[string]string `json:"selected-map"`
-	TestURL     string            `json:"test-url"`
+	Config        *config.RawConfig `json:"config"`
+	SelectedMap   map[string]string `json:"selected-map"`
+	TestURL       string            `json:"test-url"`
+	Probe         bool              `json:"probe"`
+	ProbeTimeout  int64             `json:"probe-timeout"`
+	Overrides     []ConfigOverride  `json:"overrides"`
+	Script        string            `json:"script"`
+	ScriptTimeout int64             `json:"script-timeout"`
+
+	// merged is Config with the overrides merged, before the script ran
+	merged *config.RawConfig
+}
+
+type SetupStage string
+
+const (
+	ScriptSetupStage SetupStage = "script"
+	ParseSetupStage  SetupStage = "parse"
+	ListenSetupStage SetupStage = "listen"
+	ProbeSetupStage  SetupStage = "probe"
+)
+
+type ProbeResult struct {
+	Url   string `json:"url"`
+	Delay int64  `json:"delay"`
+	Error string `json:"error,omitempty"`
+}
+
+type SetupResult struct {
+	Applied       bool            `json:"applied"`
+	RolledBack    bool            `json:"rolled-back"`
+	Stage         SetupStage      `json:"stage,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	Proxies       int             `json:"proxies"`
+	Providers     int             `json:"providers"`
+	Rules         int             `json:"rules"`
+	RuleProviders int             `json:"rule-providers"`
+	Ports         *listener.Ports `json:"ports,omitempty"`
+	Probe         *ProbeResult    `json:"probe,omitempty"`
+	Reloaded      []string        `json:"reloaded"`
+	Diagnostics   []*Diagnostic   `json:"diagnostics,omitempty"`
+	Duration      int64           `json:"duration"`
 }
 
 type UpdateParams struct {
@@ -36,15 +76,35 @@ type UpdateParams struct {
 	ExternalController *string            `json:"external-controller"`
 	Interface          *string            `json:"interface-name"`
 	UnifiedDelay       *bool              `json:"unified-delay"`
+	Port               *int               `json:"port"`
+	SocksPort          *int               `json:"socks-port"`
+	RedirPort          *int               `json:"redir-port"`
+	TProxyPort         *int               `json:"tproxy-port"`
+	Authentication     *[]string          `json:"authentication"`
+	DNS                *dnsSchema         `json:"dns"`
+	Sniffer            *snifferSchema     `json:"sniffer"`
+	Hosts              *map[string]any    `json:"hosts"`
 }
 
 type tunSchema struct {
-	Enable       bool               `yaml:"enable" json:"enable"`
-	Device       *string            `yaml:"device" json:"device"`
-	Stack        *constant.TUNStack `yaml:"stack" json:"stack"`
-	DNSHijack    *[]string          `yaml:"dns-hijack" json:"dns-hijack"`
-	AutoRoute    *bool              `yaml:"auto-route" json:"auto-route"`
-	RouteAddress *[]netip.Prefix    `yaml:"route-address" json:"route-address,omitempty"`
+	Enable              *bool              `yaml:"enable" json:"enable"`
+	Device              *string            `yaml:"device" json:"device"`
+	Stack               *constant.TUNStack `yaml:"stack" json:"stack"`
+	DNSHijack           *[]string          `yaml:"dns-hijack" json:"dns-hijack"`
+	AutoRoute           *bool              `yaml:"auto-route" json:"auto-route"`
+	AutoDetectInterface *bool              `yaml:"auto-detect-interface" json:"auto-detect-interface"`
+	StrictRoute         *bool              `yaml:"strict-route" json:"strict-route"`
+	MTU                 *uint32            `yaml:"mtu" json:"mtu"`
+	RouteAddress        *[]netip.Prefix    `yaml:"route-address" json:"route-address,omitempty"`
+	RouteExcludeAddress *[]netip.Prefix    `yaml:"route-exclude-address" json:"route-exclude-address"`
+	IncludeInterface    *[]string          `yaml:"include-interface" json:"include-interface"`
+	ExcludeInterface    *[]string          `yaml:"exclude-interface" json:"exclude-interface"`
+	IncludeUID          *[]uint32          `yaml:"include-uid" json:"include-uid"`
+	IncludeUIDRange     *[]string          `yaml:"include-uid-range" json:"include-uid-range"`
+	ExcludeUID          *[]uint32          `yaml:"exclude-uid" json:"exclude-uid"`
+	ExcludeUIDRange     *[]string          `yaml:"exclude-uid-range" json:"exclude-uid-range"`
+	IncludePackage      *[]string          `yaml:"include-package" json:"include-package"`
+	ExcludePackage      *[]string          `yaml:"exclude-package" json:"exclude-package"`
 }
 
 type ChangeProxyParams struct {
@@ -58,6 +118,12 @@ type TestDelayParams struct {
 	Timeout   int64  `json:"timeout"`
 }
 
+type UpdateGeoDataParams struct {
+	GeoType string `json:"geo-type"`
+	GeoName string `json:"geo-name"`
+	Hash    string `json:"hash"`
+}
+
 type ExternalProvider struct {
 	Name             string                     `json:"name"`
 	Type             string                     `json:"type"`
@@ -105,6 +171,47 @@ const (
 	crashMethod                    Method = "crash"
 	setupConfigMethod              Method = "setupConfig"
 	getConfigMethod                Method = "getConfig"
+
+	diagnoseConfigMethod                    Method = "diagnoseConfig"
+	lookupMethod                            Method = "lookup"
+	explainRuleMethod                       Method = "explainRule"
+	getRuleStatsMethod                      Method = "getRuleStats"
+	resetRuleStatsMethod                    Method = "resetRuleStats"
+	getUnusedRulesMethod                    Method = "getUnusedRules"
+	insertRuleMethod                        Method = "insertRule"
+	overrideRuleMethod                      Method = "overrideRule"
+	removeRuleMethod                        Method = "removeRule"
+	moveRuleMethod                          Method = "moveRule"
+	getRuleOverlayMethod                    Method = "getRuleOverlay"
+	deleteRuleOverlayItemMethod             Method = "deleteRuleOverlayItem"
+	clearRuleOverlayMethod                  Method = "clearRuleOverlay"
+	conditionalUpdateGeoDataMethod          Method = "conditionalUpdateGeoData"
+	conditionalUpdateExternalProviderMethod Method = "conditionalUpdateExternalProvider"
+	getGeoDataInventoryMethod               Method = "getGeoDataInventory"
+	verifyGeoDataMethod                     Method = "verifyGeoData"
+	rollbackGeoDataMethod                   Method = "rollbackGeoData"
+	queryLogsMethod                         Method = "queryLogs"
+	subscribeLogMethod                      Method = "subscribeLog"
+	unsubscribeLogMethod                    Method = "unsubscribeLog"
+	setLogFileMethod                        Method = "setLogFile"
+	createDiagnosticsBundleMethod           Method = "createDiagnosticsBundle"
+	queryDnsMethod                          Method = "queryDns"
+	subscribeDnsMethod                      Method = "subscribeDns"
+	unsubscribeDnsMethod                    Method = "unsubscribeDns"
+	getDnsStatsMethod                       Method = "getDnsStats"
+	resetFakeIPPoolMethod                   Method = "resetFakeIPPool"
+	benchmarkDnsMethod                      Method = "benchmarkDns"
+	updateStateMethod                       Method = "updateState"
+	getStateMethod                          Method = "getState"
+	startTunListenerMethod                  Method = "startTunListener"
+	stopTunListenerMethod                   Method = "stopTunListener"
+	getTunStatusMethod                      Method = "getTunStatus"
+	getMergedConfigMethod                   Method = "getMergedConfig"
+	setRedactionMethod                      Method = "setRedaction"
+	getRedactionMethod                      Method = "getRedaction"
+	exportConfigMethod                      Method = "exportConfig"
+	patchConfigMethod                       Method = "patchConfig"
+	applyConfigMethod                       Method = "applyConfig"
 )
 
 type Method string
@@ -127,6 +234,10 @@ const (
 	DelayMessage   MessageType = "delay"
 	RequestMessage MessageType = "request"
 	LoadedMessage  MessageType = "loaded"
+
+	DnsQueryMessage  MessageType = "dnsQuery"
+	StateMessage     MessageType = "state"
+	TunStatusMessage MessageType = "tunStatus"
 )
 
 func (message *Message) Json() (string, error) {
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	diagnosticsDir        = "diagnostics"
+	diagnosticsMaxBundles = 5
+)
+
+type DiagnosticsBundle struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+type diagnosticsVersion struct {
+	Mihomo    string `json:"mihomo"`
+	Go        string `json:"go"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	SdkInt    int    `json:"sdk-int"`
+	CreatedAt string `json:"created-at"`
+}
+
+type diagnosticsMemory struct {
+	Alloc      uint64 `json:"alloc"`
+	TotalAlloc uint64 `json:"total-alloc"`
+	Sys        uint64 `json:"sys"`
+	HeapInuse  uint64 `json:"heap-inuse"`
+	NumGC      uint32 `json:"num-gc"`
+	Goroutines int    `json:"goroutines"`
+	Process    uint64 `json:"process"`
+}
+
+type diagnosticsWriter struct {
+	*zip.Writer
+}
+
+func (w *diagnosticsWriter) add(name string, data []byte) error {
+	file, err := w.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	return err
+}
+
+func (w *diagnosticsWriter) addJson(name string, value any) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return w.add(name, data)
+}
+
+// addLogs adds the current and rotated log files, rotated files are stored
+// decompressed.
+func (w *diagnosticsWriter) addLogs() error {
+	names := []string{logFileName}
+	plain := map[string]bool{}
+	files := rotatedLogFiles()
+	for _, file := range files {
+		plain[file.Name()] = true
+	}
+	for _, file := range files {
+		// a compressed file next to its plain one is still being written
+		if stem, ok := strings.CutSuffix(file.Name(), ".gz"); ok && plain[stem] {
+			continue
+		}
+		names = append(names, file.Name())
+	}
+	for _, name := range names {
+		data, err := readLogFile(filepath.Join(logDirPath(), name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = w.add("logs/"+strings.TrimSuffix(name, ".gz"), []byte(defaultRedactor.Redact(string(data))))
+		if err != nil {
+			return err
+		}
+	}
+	buffer := &strings.Builder{}
+	for _, record := range logs.Records() {
+		buffer.WriteString(fmt.Sprintf("%s %s %s\n", record.Time.Format(time.RFC3339Nano), record.LogLevel.String(), record.Payload))
+	}
+	return w.add("logs/buffer.log", []byte(defaultRedactor.Redact(buffer.String())))
+}
+
+// pruneDiagnosticsBundles removes the oldest bundles, keeping keep of them.
+func pruneDiagnosticsBundles(keep int) {
+	entries, err := os.ReadDir(constant.Path.Resolve(diagnosticsDir))
+	if err != nil {
+		return
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".zip") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for index, name := range names {
+		if index >= keep {
+			_ = os.Remove(constant.Path.Resolve(filepath.Join(diagnosticsDir, name)))
+		}
+	}
+}
+
+// createDiagnosticsBundle zips recent logs, the redacted running config,
+// version info, provider status and memory stats into the home dir.
+func createDiagnosticsBundle() (*DiagnosticsBundle, error) {
+	providers := handleGetExternalProviders()
+	runLock.Lock()
+	shareSafe := true
+	configData, err := exportConfig(&ExportConfigParams{ShareSafe: &shareSafe})
+	runLock.Unlock()
+	if err != nil {
+		configData = fmt.Sprintf("# %v\n", err)
+	}
+	if err = os.MkdirAll(constant.Path.Resolve(diagnosticsDir), 0o755); err != nil {
+		return nil, err
+	}
+	pruneDiagnosticsBundles(diagnosticsMaxBundles - 1)
+	now := time.Now()
+	path := constant.Path.Resolve(filepath.Join(diagnosticsDir, fmt.Sprintf("diagnostics-%s.zip", now.Format("20060102-150405"))))
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	writer := &diagnosticsWriter{zip.NewWriter(file)}
+	err = writer.addLogs()
+	if err == nil {
+		err = writer.add("config.yaml", []byte(configData))
+	}
+	if err == nil {
+		err = writer.addJson("version.json", &diagnosticsVersion{
+			Mihomo:    constant.Version,
+			Go:        runtime.Version(),
+			OS:        runtime.GOOS,
+			Arch:      runtime.GOARCH,
+			SdkInt:    version,
+			CreatedAt: now.Format(time.RFC3339),
+		})
+	}
+	if err == nil {
+		err = writer.add("providers.json", []byte(defaultRedactor.Redact(providers)))
+	}
+	if err == nil {
+		err = writer.addJson("memory.json", &diagnosticsMemory{
+			Alloc:      memStats.Alloc,
+			TotalAlloc: memStats.TotalAlloc,
+			Sys:        memStats.Sys,
+			HeapInuse:  memStats.HeapInuse,
+			NumGC:      memStats.NumGC,
+			Goroutines: runtime.NumGoroutine(),
+			Process:    statistic.DefaultManager.Memory(),
+		})
+	}
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &DiagnosticsBundle{
+		Path: path,
+		Size: info.Size(),
+	}, nil
+}
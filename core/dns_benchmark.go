@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/dns"
+	"github.com/metacubex/mihomo/tunnel"
+	D "github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDnsBenchmarkCount   = 3
+	defaultDnsBenchmarkTimeout = 5000
+	maxDnsBenchmarkErrors      = 5
+)
+
+type DnsBenchmarkParams struct {
+	Upstreams []string `json:"upstreams"`
+	Domains   []string `json:"domains"`
+	Type      string   `json:"type"`
+	Proxy     string   `json:"proxy"`
+	Count     int      `json:"count"`
+	Timeout   int64    `json:"timeout"`
+}
+
+type DnsUpstreamBenchmark struct {
+	Upstream    string              `json:"upstream"`
+	Queries     int                 `json:"queries"`
+	Failures    int                 `json:"failures"`
+	FailureRate float64             `json:"failure-rate"`
+	Min         int64               `json:"min"`
+	Avg         int64               `json:"avg"`
+	P50         int64               `json:"p50"`
+	P90         int64               `json:"p90"`
+	P99         int64               `json:"p99"`
+	Max         int64               `json:"max"`
+	Consistency float64             `json:"consistency"`
+	Answers     map[string][]string `json:"answers"`
+	Errors      []string            `json:"errors"`
+}
+
+type DnsBenchmarkResult struct {
+	Type      string                  `json:"type"`
+	Proxy     string                  `json:"proxy,omitempty"`
+	Upstreams []*DnsUpstreamBenchmark `json:"upstreams"`
+}
+
+func hostWithDefaultPort(host string, port string) (string, error) {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host, nil
+	}
+	if host == "" {
+		return "", errors.New("missing host")
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port), nil
+}
+
+// parseBenchmarkUpstream turns an upstream in nameserver notation into a
+// mihomo nameserver, a bare address is queried over udp.
+func parseBenchmarkUpstream(upstream string, proxy string) (dns.NameServer, error) {
+	// a bare ipv6 address is no valid url host, its colons read as a port
+	if addr, err := netip.ParseAddr(strings.Trim(upstream, "[]")); err == nil {
+		return dns.NameServer{
+			Addr:      net.JoinHostPort(addr.String(), "53"),
+			ProxyName: proxy,
+			Params:    map[string]string{},
+		}, nil
+	}
+	server := upstream
+	if !strings.Contains(server, "://") {
+		server = "udp://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return dns.NameServer{}, err
+	}
+	nameServer := dns.NameServer{
+		ProxyName: proxy,
+		Params:    map[string]string{},
+	}
+	switch u.Scheme {
+	case "udp":
+		nameServer.Addr, err = hostWithDefaultPort(u.Host, "53")
+	case "tcp":
+		nameServer.Net = "tcp"
+		nameServer.Addr, err = hostWithDefaultPort(u.Host, "53")
+	case "tls":
+		nameServer.Net = "tcp-tls"
+		nameServer.Addr, err = hostWithDefaultPort(u.Host, "853")
+	case "https", "http":
+		nameServer.Net = "https"
+		port := "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+		var host string
+		host, err = hostWithDefaultPort(u.Host, port)
+		nameServer.Addr = (&url.URL{Scheme: u.Scheme, Host: host, Path: u.Path, User: u.User}).String()
+	case "quic":
+		nameServer.Net = "quic"
+		nameServer.Addr, err = hostWithDefaultPort(u.Host, "853")
+	default:
+		return dns.NameServer{}, fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+	return nameServer, err
+}
+
+// percentile returns the p-th percentile of sorted latencies.
+func percentile(latencies []int64, p int) int64 {
+	if len(latencies) == 0 {
+		return 0
+	}
+	index := (len(latencies)*p + 99) / 100
+	if index < 1 {
+		index = 1
+	}
+	return latencies[index-1]
+}
+
+func answerIPs(msg *D.Msg) []string {
+	answers := []string{}
+	for _, answer := range msg.Answer {
+		switch record := answer.(type) {
+		case *D.A:
+			answers = append(answers, record.A.String())
+		case *D.AAAA:
+			answers = append(answers, record.AAAA.String())
+		}
+	}
+	sort.Strings(answers)
+	return answers
+}
+
+// benchmarkUpstream queries upstream, defaultNameserver resolves its host.
+func benchmarkUpstream(params *DnsBenchmarkParams, upstream string, qType uint16, defaultNameserver []dns.NameServer) *DnsUpstreamBenchmark {
+	result := &DnsUpstreamBenchmark{
+		Upstream: upstream,
+		Answers:  map[string][]string{},
+		Errors:   []string{},
+	}
+	addError := func(err error) {
+		result.Failures++
+		if len(result.Errors) < maxDnsBenchmarkErrors {
+			result.Errors = append(result.Errors, err.Error())
+		}
+	}
+	nameServer, err := parseBenchmarkUpstream(upstream, params.Proxy)
+	if err != nil {
+		result.Queries = len(params.Domains) * params.Count
+		result.Failures = result.Queries
+		result.FailureRate = 1
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+	r := dns.NewResolver(dns.Config{
+		Main:    []dns.NameServer{nameServer},
+		Default: defaultNameserver,
+	})
+	defer r.ResetConnection()
+	var latencies []int64
+	for i := 0; i < params.Count; i++ {
+		for _, domain := range params.Domains {
+			result.Queries++
+			msg := &D.Msg{}
+			msg.SetQuestion(D.Fqdn(domain), qType)
+			// every query has to reach the upstream
+			r.ClearCache()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(params.Timeout)*time.Millisecond)
+			start := time.Now()
+			answer, err := r.ExchangeContext(ctx, msg)
+			latency := time.Since(start).Milliseconds()
+			cancel()
+			if err != nil {
+				addError(fmt.Errorf("%s: %v", domain, err))
+				continue
+			}
+			if answer.Rcode != D.RcodeSuccess && answer.Rcode != D.RcodeNameError {
+				addError(fmt.Errorf("%s: %s", domain, D.RcodeToString[answer.Rcode]))
+				continue
+			}
+			latencies = append(latencies, latency)
+			if _, ok := result.Answers[domain]; !ok {
+				result.Answers[domain] = answerIPs(answer)
+			}
+		}
+	}
+	if result.Queries > 0 {
+		result.FailureRate = float64(result.Failures) / float64(result.Queries)
+	}
+	if len(latencies) == 0 {
+		return result
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	var total int64
+	for _, latency := range latencies {
+		total += latency
+	}
+	result.Min = latencies[0]
+	result.Max = latencies[len(latencies)-1]
+	result.Avg = total / int64(len(latencies))
+	result.P50 = percentile(latencies, 50)
+	result.P90 = percentile(latencies, 90)
+	result.P99 = percentile(latencies, 99)
+	return result
+}
+
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return len(a) == 0 && len(b) == 0
+}
+
+// scoreConsistency sets the share of domains for which an upstream agrees,
+// sharing at least one answer, with at least half of the other upstreams.
+func scoreConsistency(results []*DnsUpstreamBenchmark) {
+	for _, result := range results {
+		consistent := 0
+		for domain, answers := range result.Answers {
+			others, agreed := 0, 0
+			for _, other := range results {
+				otherAnswers, ok := other.Answers[domain]
+				if other == result || !ok {
+					continue
+				}
+				others++
+				if intersects(answers, otherAnswers) {
+					agreed++
+				}
+			}
+			if agreed*2 >= others {
+				consistent++
+			}
+		}
+		if len(result.Answers) > 0 {
+			result.Consistency = float64(consistent) / float64(len(result.Answers))
+		}
+	}
+}
+
+// benchmarkDns queries every domain Count times on each upstream, the
+// upstreams run in parallel and each of them sequentially.
+func benchmarkDns(params *DnsBenchmarkParams) (*DnsBenchmarkResult, error) {
+	if len(params.Upstreams) == 0 {
+		return nil, errors.New("upstreams must not be empty")
+	}
+	if len(params.Domains) == 0 {
+		return nil, errors.New("domains must not be empty")
+	}
+	if params.Type == "" {
+		params.Type = "A"
+	}
+	qType, ok := D.StringToType[strings.ToUpper(params.Type)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported type %s", params.Type)
+	}
+	if params.Proxy != "" {
+		if _, ok := tunnel.Proxies()[params.Proxy]; !ok {
+			return nil, fmt.Errorf("proxy %s not found", params.Proxy)
+		}
+	}
+	if params.Count <= 0 {
+		params.Count = defaultDnsBenchmarkCount
+	}
+	if params.Timeout <= 0 {
+		params.Timeout = defaultDnsBenchmarkTimeout
+	}
+	// the upstreams run without the lock, a reload must not change the
+	// config under them
+	var defaultNameserver []dns.NameServer
+	runLock.Lock()
+	if currentConfig != nil && currentConfig.DNS != nil {
+		defaultNameserver = currentConfig.DNS.DefaultNameserver
+	}
+	runLock.Unlock()
+	results := make([]*DnsUpstreamBenchmark, len(params.Upstreams))
+	wg := &sync.WaitGroup{}
+	for index, upstream := range params.Upstreams {
+		wg.Add(1)
+		go func(index int, upstream string) {
+			defer wg.Done()
+			results[index] = benchmarkUpstream(params, upstream, qType, defaultNameserver)
+		}(index, upstream)
+	}
+	wg.Wait()
+	scoreConsistency(results)
+	return &DnsBenchmarkResult{
+		Type:      strings.ToUpper(params.Type),
+		Proxy:     params.Proxy,
+		Upstreams: results,
+	}, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	D "github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTestDnsServer serves A records of 192.0.2.1 on a loopback port over
+// both udp and tcp and returns the address.
+func startTestDnsServer(t *testing.T) string {
+	t.Helper()
+	handler := D.HandlerFunc(func(w D.ResponseWriter, r *D.Msg) {
+		msg := &D.Msg{}
+		msg.SetReply(r)
+		for _, question := range r.Question {
+			if question.Qtype != D.TypeA {
+				continue
+			}
+			msg.Answer = append(msg.Answer, &D.A{
+				Hdr: D.RR_Header{Name: question.Name, Rrtype: D.TypeA, Class: D.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, 1),
+			})
+		}
+		_ = w.WriteMsg(msg)
+	})
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	if err != nil {
+		packetConn.Close()
+		t.Fatal(err)
+	}
+	servers := []*D.Server{
+		{PacketConn: packetConn, Handler: handler},
+		{Listener: listener, Handler: handler},
+	}
+	for _, server := range servers {
+		go server.ActivateAndServe()
+	}
+	t.Cleanup(func() {
+		for _, server := range servers {
+			_ = server.Shutdown()
+		}
+	})
+	return packetConn.LocalAddr().String()
+}
+
+func TestBenchmarkDns(t *testing.T) {
+	addr := startTestDnsServer(t)
+	result, err := benchmarkDns(&DnsBenchmarkParams{
+		Upstreams: []string{addr, "udp://" + addr, "tcp://" + addr},
+		Domains:   []string{"example.com", "example.org"},
+		Count:     2,
+		Timeout:   2000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Type != "A" || len(result.Upstreams) != 3 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	for _, upstream := range result.Upstreams {
+		if upstream.Queries != 4 || upstream.Failures != 0 {
+			t.Errorf("%s: %d queries, %d failures, errors %v", upstream.Upstream, upstream.Queries, upstream.Failures, upstream.Errors)
+		}
+		if answers := upstream.Answers["example.com"]; len(answers) != 1 || answers[0] != "192.0.2.1" {
+			t.Errorf("%s: answers %v", upstream.Upstream, answers)
+		}
+		if upstream.Consistency != 1 {
+			t.Errorf("%s: consistency %v", upstream.Upstream, upstream.Consistency)
+		}
+	}
+}
+
+func TestBenchmarkDnsUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	result, err := benchmarkDns(&DnsBenchmarkParams{
+		Upstreams: []string{"tcp://" + addr},
+		Domains:   []string{"example.com"},
+		Count:     1,
+		Timeout:   500,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upstream := result.Upstreams[0]; upstream.Failures != 1 || upstream.FailureRate != 1 || len(upstream.Errors) != 1 {
+		t.Fatalf("unexpected result %+v", upstream)
+	}
+}
+
+func TestBenchmarkDnsParams(t *testing.T) {
+	for _, params := range []*DnsBenchmarkParams{
+		{Domains: []string{"example.com"}},
+		{Upstreams: []string{"127.0.0.1"}},
+		{Upstreams: []string{"127.0.0.1"}, Domains: []string{"example.com"}, Type: "BOGUS"},
+	} {
+		if _, err := benchmarkDns(params); err == nil {
+			t.Errorf("%+v: expected an error", params)
+		}
+	}
+}
+
+func TestParseBenchmarkUpstream(t *testing.T) {
+	for _, test := range []struct {
+		upstream string
+		net      string
+		addr     string
+	}{
+		{"1.1.1.1", "", "1.1.1.1:53"},
+		{"1.1.1.1:5353", "", "1.1.1.1:5353"},
+		{"::1", "", "[::1]:53"},
+		{"2001:db8::1", "", "[2001:db8::1]:53"},
+		{"[::1]", "", "[::1]:53"},
+		{"[::1]:5353", "", "[::1]:5353"},
+		{"udp://[::1]", "", "[::1]:53"},
+		{"tcp://1.1.1.1", "tcp", "1.1.1.1:53"},
+		{"tls://dns.example", "tcp-tls", "dns.example:853"},
+		{"https://dns.example/dns-query", "https", "https://dns.example:443/dns-query"},
+		{"quic://[2001:db8::1]:8853", "quic", "[2001:db8::1]:8853"},
+	} {
+		nameServer, err := parseBenchmarkUpstream(test.upstream, "")
+		if err != nil {
+			t.Errorf("%s: %v", test.upstream, err)
+			continue
+		}
+		if nameServer.Net != test.net || nameServer.Addr != test.addr {
+			t.Errorf("%s: got %s %s, want %s %s", test.upstream, nameServer.Net, nameServer.Addr, test.net, test.addr)
+		}
+	}
+	if _, err := parseBenchmarkUpstream("ftp://1.1.1.1", ""); err == nil {
+		t.Error("ftp://1.1.1.1: expected an error")
+	}
+}
+
+func TestBenchmarkDnsWaitsForRunLock(t *testing.T) {
+	addr := startTestDnsServer(t)
+	runLock.Lock()
+	done := make(chan *DnsBenchmarkResult)
+	go func() {
+		result, _ := benchmarkDns(&DnsBenchmarkParams{
+			Upstreams: []string{addr},
+			Domains:   []string{"example.com"},
+			Count:     1,
+			Timeout:   2000,
+		})
+		done <- result
+	}()
+	select {
+	case <-done:
+		runLock.Unlock()
+		t.Fatal("read the running config while runLock was held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	runLock.Unlock()
+	if result := <-done; result == nil || result.Upstreams[0].Failures != 0 {
+		t.Fatalf("result = %+v", result)
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/metacubex/mihomo/common/utils"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/log"
+	D "github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnsQueryBufferSize = 1000
+	fakeIPUpstream     = "fake-ip"
+	cacheUpstream      = "cache"
+)
+
+type DnsQuery struct {
+	Id           uint64    `json:"id"`
+	Name         string    `json:"name"`
+	Type         string    `json:"type"`
+	Upstream     string    `json:"upstream"`
+	Answer       []string  `json:"answer"`
+	Latency      int64     `json:"latency"`
+	CacheHit     bool      `json:"cache-hit"`
+	FakeIP       bool      `json:"fake-ip"`
+	Error        string    `json:"error,omitempty"`
+	Time         time.Time `json:"time"`
+	Subscription string    `json:"subscription,omitempty"`
+}
+
+type DnsUpstreamStats struct {
+	Upstream   string `json:"upstream"`
+	Queries    int64  `json:"queries"`
+	Answers    int64  `json:"answers"`
+	Failures   int64  `json:"failures"`
+	AvgLatency int64  `json:"avg-latency"`
+	MaxLatency int64  `json:"max-latency"`
+	LastError  string `json:"last-error,omitempty"`
+
+	totalLatency int64
+}
+
+type DnsStats struct {
+	Queries   int64               `json:"queries"`
+	CacheHits int64               `json:"cache-hits"`
+	FakeIP    int64               `json:"fake-ip"`
+	Failures  int64               `json:"failures"`
+	Upstreams []*DnsUpstreamStats `json:"upstreams"`
+}
+
+type QueryDnsParams struct {
+	Keyword  string     `json:"keyword"`
+	Type     string     `json:"type"`
+	Upstream string     `json:"upstream"`
+	Failed   bool       `json:"failed"`
+	Since    *time.Time `json:"since"`
+	Limit    int        `json:"limit"`
+}
+
+var (
+	// [DNS] resolve example.com A from tls://1.1.1.1:853
+	dnsResolveRegexp = regexp.MustCompile(`^\[DNS\] resolve (\S+) (\S+) from (.+)$`)
+	// [DNS] example.com --> [1.1.1.1 2.2.2.2] A from tls://1.1.1.1:853
+	dnsAnswerRegexp = regexp.MustCompile(`^\[DNS\] (\S+) --> \[([^\]]*)\] (\S+) from (.+)$`)
+	// [DNS] cache hit example.com --> [1.1.1.1] A, expire at 2006-01-02 15:04:05
+	dnsCacheHitRegexp = regexp.MustCompile(`^\[DNS\] cache hit (\S+) --> \[([^\]]*)\] (\S+), expire at`)
+	// [DNS] resolve example.com A,AAAA failed: connection refused, see logDnsFailure
+	dnsFailureRegexp = regexp.MustCompile(`^\[DNS\] resolve (\S+) (\S+) failed: (.*)$`)
+)
+
+// dnsQueryStore builds the query log from the debug events of the mihomo
+// resolver, which attribute questions and answers to upstreams, the failures
+// reported by dnsHookResolver and the answers of the local server, which
+// covers fake-ip.
+type dnsQueryStore struct {
+	sync.Mutex
+	queries       []*DnsQuery
+	next          int
+	lastId        uint64
+	pending       map[string]*dnsPending
+	expireTimer   *time.Timer
+	stats         DnsStats
+	upstreams     map[string]*DnsUpstreamStats
+	subscriptions map[string]bool
+}
+
+var dnsQueries = &dnsQueryStore{
+	queries:       make([]*DnsQuery, 0, dnsQueryBufferSize),
+	pending:       map[string]*dnsPending{},
+	upstreams:     map[string]*DnsUpstreamStats{},
+	subscriptions: map[string]bool{},
+}
+
+// dnsPending holds the upstreams a question was sent to and when, answered
+// is set once any of them answered.
+type dnsPending struct {
+	upstreams map[string]time.Time
+	answered  bool
+}
+
+func dnsPendingKey(name, qType string) string {
+	return name + " " + qType
+}
+
+func splitAnswer(answer string) []string {
+	fields := strings.Fields(answer)
+	if fields == nil {
+		return []string{}
+	}
+	return fields
+}
+
+func (s *dnsQueryStore) upstream(name string) *DnsUpstreamStats {
+	stats, ok := s.upstreams[name]
+	if !ok {
+		stats = &DnsUpstreamStats{Upstream: name}
+		s.upstreams[name] = stats
+	}
+	return stats
+}
+
+// Observe feeds a log payload to the store, payloads that are not resolver
+// events are ignored.
+func (s *dnsQueryStore) Observe(payload string, now time.Time) {
+	if !strings.HasPrefix(payload, dnsLogPrefix) {
+		return
+	}
+	var queries []*DnsQuery
+	s.Lock()
+	queries = s.expire(now)
+	if match := dnsFailureRegexp.FindStringSubmatch(payload); match != nil {
+		queries = append(queries, s.fail(match[1], match[2], match[3], now)...)
+	} else if match = dnsResolveRegexp.FindStringSubmatch(payload); match != nil {
+		key := dnsPendingKey(match[1], match[2])
+		pending, ok := s.pending[key]
+		if !ok || pending.answered {
+			pending = &dnsPending{upstreams: map[string]time.Time{}}
+			s.pending[key] = pending
+		}
+		pending.upstreams[match[3]] = now
+		s.upstream(match[3]).Queries++
+		s.scheduleExpire(now)
+	} else if match = dnsAnswerRegexp.FindStringSubmatch(payload); match != nil {
+		key := dnsPendingKey(match[1], match[3])
+		query := &DnsQuery{
+			Name:     match[1],
+			Type:     match[3],
+			Upstream: match[4],
+			Answer:   splitAnswer(match[2]),
+			Time:     now,
+		}
+		if pending, ok := s.pending[key]; ok {
+			if start, ok := pending.upstreams[match[4]]; ok {
+				query.Latency = now.Sub(start).Milliseconds()
+				delete(pending.upstreams, match[4])
+			}
+			pending.answered = true
+			if len(pending.upstreams) == 0 {
+				delete(s.pending, key)
+			}
+		}
+		stats := s.upstream(match[4])
+		stats.Answers++
+		stats.totalLatency += query.Latency
+		stats.AvgLatency = stats.totalLatency / stats.Answers
+		if query.Latency > stats.MaxLatency {
+			stats.MaxLatency = query.Latency
+		}
+		queries = append(queries, query)
+	} else if match = dnsCacheHitRegexp.FindStringSubmatch(payload); match != nil {
+		s.stats.CacheHits++
+		queries = append(queries, &DnsQuery{
+			Name:     match[1],
+			Type:     match[3],
+			Upstream: cacheUpstream,
+			Answer:   splitAnswer(match[2]),
+			CacheHit: true,
+			Time:     now,
+		})
+	}
+	s.Unlock()
+	s.add(queries...)
+}
+
+// fail turns the upstreams still waiting for an answer to name into failures
+// with the error the resolver gave up with, qTypes lists the types of the
+// lookup separated by commas. A lookup that reached no upstream is recorded
+// without one. The lock must be held.
+func (s *dnsQueryStore) fail(name, qTypes, message string, now time.Time) []*DnsQuery {
+	var queries []*DnsQuery
+	asked := false
+	for _, qType := range strings.Split(qTypes, ",") {
+		key := dnsPendingKey(name, qType)
+		pending, ok := s.pending[key]
+		if !ok {
+			continue
+		}
+		asked = true
+		delete(s.pending, key)
+		// the upstreams left after an answer were canceled
+		if pending.answered {
+			continue
+		}
+		for upstream, start := range pending.upstreams {
+			stats := s.upstream(upstream)
+			stats.Failures++
+			stats.LastError = message
+			queries = append(queries, &DnsQuery{
+				Name:     name,
+				Type:     qType,
+				Upstream: upstream,
+				Answer:   []string{},
+				Latency:  now.Sub(start).Milliseconds(),
+				Error:    message,
+				Time:     now,
+			})
+		}
+	}
+	if !asked {
+		queries = append(queries, &DnsQuery{
+			Name:   name,
+			Type:   qTypes,
+			Answer: []string{},
+			Error:  message,
+			Time:   now,
+		})
+	}
+	return queries
+}
+
+// expire turns the queries no upstream answered within the dns timeout into
+// failures, the lock must be held. Upstreams still pending once another one
+// answered were canceled by the resolver and are dropped.
+func (s *dnsQueryStore) expire(now time.Time) []*DnsQuery {
+	var queries []*DnsQuery
+	for key, pending := range s.pending {
+		name, qType, _ := strings.Cut(key, " ")
+		for upstream, start := range pending.upstreams {
+			if now.Sub(start) < resolver.DefaultDNSTimeout {
+				continue
+			}
+			delete(pending.upstreams, upstream)
+			if pending.answered {
+				continue
+			}
+			stats := s.upstream(upstream)
+			stats.Failures++
+			stats.LastError = "no answer"
+			queries = append(queries, &DnsQuery{
+				Name:     name,
+				Type:     qType,
+				Upstream: upstream,
+				Answer:   []string{},
+				Latency:  now.Sub(start).Milliseconds(),
+				Error:    stats.LastError,
+				Time:     now,
+			})
+		}
+		if len(pending.upstreams) == 0 {
+			delete(s.pending, key)
+		}
+	}
+	return queries
+}
+
+// scheduleExpire arms the timer expiring the oldest pending query, so
+// failures are reported without waiting for the next dns event. The lock
+// must be held.
+func (s *dnsQueryStore) scheduleExpire(now time.Time) {
+	if s.expireTimer != nil {
+		return
+	}
+	var oldest time.Time
+	for _, pending := range s.pending {
+		for _, start := range pending.upstreams {
+			if oldest.IsZero() || start.Before(oldest) {
+				oldest = start
+			}
+		}
+	}
+	if oldest.IsZero() {
+		return
+	}
+	s.expireTimer = time.AfterFunc(oldest.Add(resolver.DefaultDNSTimeout).Sub(now), func() {
+		s.Lock()
+		s.expireTimer = nil
+		now := time.Now()
+		queries := s.expire(now)
+		s.scheduleExpire(now)
+		s.Unlock()
+		s.add(queries...)
+	})
+}
+
+func (s *dnsQueryStore) add(queries ...*DnsQuery) {
+	if len(queries) == 0 {
+		return
+	}
+	s.Lock()
+	for _, query := range queries {
+		s.lastId++
+		query.Id = s.lastId
+		s.stats.Queries++
+		if query.Error != "" {
+			s.stats.Failures++
+		}
+		if query.FakeIP {
+			s.stats.FakeIP++
+		}
+		if len(s.queries) < dnsQueryBufferSize {
+			s.queries = append(s.queries, query)
+		} else {
+			s.queries[s.next] = query
+			s.next = (s.next + 1) % dnsQueryBufferSize
+		}
+	}
+	subscriptions := make([]string, 0, len(s.subscriptions))
+	for id := range s.subscriptions {
+		subscriptions = append(subscriptions, id)
+	}
+	s.Unlock()
+	for _, id := range subscriptions {
+		for _, query := range queries {
+			data := *query
+			data.Subscription = id
+			sendMessage(Message{
+				Type: DnsQueryMessage,
+				Data: &data,
+			})
+		}
+	}
+}
+
+// Queries returns the buffered queries from the oldest to the newest.
+func (s *dnsQueryStore) Queries() []*DnsQuery {
+	s.Lock()
+	defer s.Unlock()
+	queries := make([]*DnsQuery, 0, len(s.queries))
+	queries = append(queries, s.queries[s.next:]...)
+	queries = append(queries, s.queries[:s.next]...)
+	return queries
+}
+
+func (s *dnsQueryStore) Stats() *DnsStats {
+	s.Lock()
+	defer s.Unlock()
+	stats := s.stats
+	stats.Upstreams = make([]*DnsUpstreamStats, 0, len(s.upstreams))
+	for _, upstream := range s.upstreams {
+		item := *upstream
+		stats.Upstreams = append(stats.Upstreams, &item)
+	}
+	sort.Slice(stats.Upstreams, func(i, j int) bool {
+		return stats.Upstreams[i].Upstream < stats.Upstreams[j].Upstream
+	})
+	return &stats
+}
+
+func (s *dnsQueryStore) Subscribe() string {
+	id := utils.NewUUIDV4().String()
+	s.Lock()
+	defer s.Unlock()
+	s.subscriptions[id] = true
+	return id
+}
+
+func (s *dnsQueryStore) UnSubscribe(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+	ok := s.subscriptions[id]
+	delete(s.subscriptions, id)
+	return ok
+}
+
+func queryDns(params *QueryDnsParams) []*DnsQuery {
+	keyword := strings.ToLower(params.Keyword)
+	result := []*DnsQuery{}
+	for _, query := range dnsQueries.Queries() {
+		if keyword != "" && !strings.Contains(strings.ToLower(query.Name), keyword) {
+			continue
+		}
+		if params.Type != "" && !strings.EqualFold(query.Type, params.Type) {
+			continue
+		}
+		if params.Upstream != "" && query.Upstream != params.Upstream {
+			continue
+		}
+		if params.Failed && query.Error == "" {
+			continue
+		}
+		if params.Since != nil && query.Time.Before(*params.Since) {
+			continue
+		}
+		result = append(result, query)
+	}
+	if params.Limit > 0 && len(result) > params.Limit {
+		result = result[len(result)-params.Limit:]
+	}
+	return result
+}
+
+// dnsLocalServer records the queries answered from the fake-ip pool and
+// reports the failed ones.
+type dnsLocalServer struct {
+	resolver.LocalServer
+}
+
+func (s *dnsLocalServer) ServeMsg(ctx context.Context, msg *D.Msg) (*D.Msg, error) {
+	start := time.Now()
+	result, err := s.LocalServer.ServeMsg(ctx, msg)
+	if len(msg.Question) == 0 {
+		return result, err
+	}
+	question := msg.Question[0]
+	query := &DnsQuery{
+		Name:    strings.TrimSuffix(question.Name, "."),
+		Type:    D.Type(question.Qtype).String(),
+		Answer:  []string{},
+		Latency: time.Since(start).Milliseconds(),
+		Time:    time.Now(),
+	}
+	if err != nil {
+		logDnsFailure(query.Name, query.Type, err)
+		return result, err
+	}
+	for _, answer := range result.Answer {
+		switch record := answer.(type) {
+		case *D.A:
+			query.Answer = append(query.Answer, record.A.String())
+			query.FakeIP = query.FakeIP || isFakeIP(record.A)
+		case *D.AAAA:
+			query.Answer = append(query.Answer, record.AAAA.String())
+			query.FakeIP = query.FakeIP || isFakeIP(record.AAAA)
+		}
+	}
+	if query.FakeIP {
+		query.Upstream = fakeIPUpstream
+		dnsQueries.add(query)
+	}
+	return result, err
+}
+
+func isFakeIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	return ok && resolver.IsFakeIP(addr.Unmap())
+}
+
+// logDnsFailure logs a lookup the resolver gave up on, mihomo does not log
+// upstream errors. The event follows the resolve events of the lookup through
+// the logger, so dnsQueries fails the right upstreams. An empty answer is
+// logged as an answer already.
+func logDnsFailure(name, qTypes string, err error) {
+	if errors.Is(err, resolver.ErrIPNotFound) || errors.Is(err, resolver.ErrIPv6Disabled) {
+		return
+	}
+	log.Warnln("[DNS] resolve %s %s failed: %v", name, qTypes, err)
+}
+
+// dnsHookResolver reports the failed lookups of a resolver.
+type dnsHookResolver struct {
+	resolver.Resolver
+}
+
+func (r *dnsHookResolver) LookupIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	ips, err := r.Resolver.LookupIP(ctx, host)
+	if err != nil {
+		logDnsFailure(host, "A,AAAA", err)
+	}
+	return ips, err
+}
+
+func (r *dnsHookResolver) LookupIPv4(ctx context.Context, host string) ([]netip.Addr, error) {
+	ips, err := r.Resolver.LookupIPv4(ctx, host)
+	if err != nil {
+		logDnsFailure(host, "A", err)
+	}
+	return ips, err
+}
+
+func (r *dnsHookResolver) LookupIPv6(ctx context.Context, host string) ([]netip.Addr, error) {
+	ips, err := r.Resolver.LookupIPv6(ctx, host)
+	if err != nil {
+		logDnsFailure(host, "AAAA", err)
+	}
+	return ips, err
+}
+
+func (r *dnsHookResolver) ExchangeContext(ctx context.Context, msg *D.Msg) (*D.Msg, error) {
+	result, err := r.Resolver.ExchangeContext(ctx, msg)
+	if err != nil && len(msg.Question) > 0 {
+		question := msg.Question[0]
+		logDnsFailure(strings.TrimSuffix(question.Name, "."), D.Type(question.Qtype).String(), err)
+	}
+	return result, err
+}
+
+func hookResolver(r resolver.Resolver) resolver.Resolver {
+	if r == nil {
+		return nil
+	}
+	if _, ok := r.(*dnsHookResolver); ok {
+		return r
+	}
+	return &dnsHookResolver{r}
+}
+
+// hookDnsResolvers wraps the resolvers and the local server used by dns
+// hijack, it must be called every time the resolver is recreated.
+func hookDnsResolvers() {
+	resolver.DefaultResolver = hookResolver(resolver.DefaultResolver)
+	resolver.ProxyServerHostResolver = hookResolver(resolver.ProxyServerHostResolver)
+	resolver.DirectHostResolver = hookResolver(resolver.DirectHostResolver)
+	server := resolver.DefaultLocalServer
+	if server == nil {
+		return
+	}
+	if _, ok := server.(*dnsLocalServer); ok {
+		return
+	}
+	resolver.DefaultLocalServer = &dnsLocalServer{server}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/log"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDnsQueryStore() *dnsQueryStore {
+	return &dnsQueryStore{
+		queries:       make([]*DnsQuery, 0, dnsQueryBufferSize),
+		pending:       map[string]*dnsPending{},
+		upstreams:     map[string]*DnsUpstreamStats{},
+		subscriptions: map[string]bool{},
+	}
+}
+
+func TestDnsQueryStoreObserve(t *testing.T) {
+	store := newTestDnsQueryStore()
+	start := time.Now()
+	store.Observe("[DNS] resolve example.com A from udp://192.0.2.1:53", start)
+	store.Observe("[DNS] resolve example.com A from tls://192.0.2.2:853", start)
+	store.Observe("[DNS] example.com --> [198.51.100.1 198.51.100.2] A from udp://192.0.2.1:53", start.Add(20*time.Millisecond))
+	store.Observe("[DNS] cache hit example.com --> [198.51.100.1] A, expire at 2006-01-02 15:04:05", start.Add(time.Second))
+	store.Observe("[DNS Server] Exchange example.com failed", start.Add(time.Second))
+
+	queries := store.Queries()
+	if len(queries) != 2 {
+		t.Fatalf("%d queries recorded, want 2", len(queries))
+	}
+	if answer := queries[0]; answer.Upstream != "udp://192.0.2.1:53" || answer.Latency != 20 || len(answer.Answer) != 2 {
+		t.Fatalf("answer = %+v", answer)
+	}
+	if hit := queries[1]; !hit.CacheHit || hit.Upstream != cacheUpstream {
+		t.Fatalf("cache hit = %+v", hit)
+	}
+	// the upstream canceled after the answer is not a failure
+	store.Observe("[DNS] resolve example.org A from udp://192.0.2.1:53", start.Add(resolver.DefaultDNSTimeout+time.Second))
+	if stats := store.Stats(); stats.Failures != 0 || stats.CacheHits != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestDnsQueryStoreFailure(t *testing.T) {
+	store := newTestDnsQueryStore()
+	start := time.Now()
+	store.Observe("[DNS] resolve example.com A from udp://192.0.2.1:53", start)
+	store.Observe("[DNS] resolve example.com A from tls://192.0.2.2:853", start)
+	store.Observe("[DNS] resolve example.com AAAA from udp://192.0.2.1:53", start)
+	store.Observe("[DNS] resolve example.com A,AAAA failed: connect: connection refused", start.Add(30*time.Millisecond))
+
+	queries := store.Queries()
+	if len(queries) != 3 {
+		t.Fatalf("%d queries recorded, want a failure per upstream and type", len(queries))
+	}
+	for _, query := range queries {
+		if query.Error != "connect: connection refused" || query.Latency != 30 || query.Upstream == "" {
+			t.Fatalf("failure = %+v", query)
+		}
+	}
+	if len(store.pending) != 0 {
+		t.Fatalf("failed lookups still pending: %v", store.pending)
+	}
+	// nothing is left to time out as no answer
+	store.Observe("[DNS] resolve example.org A from udp://192.0.2.1:53", start.Add(resolver.DefaultDNSTimeout+time.Second))
+	if len(store.Queries()) != 3 {
+		t.Fatal("a failed lookup was reported again by the timeout")
+	}
+
+	store.Observe("[DNS] resolve example.net AAAA failed: context canceled", start)
+	if query := store.Queries()[3]; query.Name != "example.net" || query.Type != "AAAA" || query.Upstream != "" || query.Error != "context canceled" {
+		t.Fatalf("failure without an upstream = %+v", query)
+	}
+	stats := store.Stats()
+	if stats.Failures != 4 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	for _, upstream := range stats.Upstreams {
+		if upstream.Upstream == "tls://192.0.2.2:853" && (upstream.Failures != 1 || upstream.LastError != "connect: connection refused") {
+			t.Fatalf("upstream stats = %+v", upstream)
+		}
+	}
+}
+
+type failingResolver struct {
+	resolver.Resolver
+	err error
+}
+
+func (r *failingResolver) LookupIPv4(context.Context, string) ([]netip.Addr, error) {
+	return nil, r.err
+}
+
+func TestDnsHookResolver(t *testing.T) {
+	subscriber := log.Subscribe()
+	defer log.UnSubscribe(subscriber)
+	next := func() string {
+		for {
+			select {
+			case event := <-subscriber:
+				if strings.HasPrefix(event.Payload, "[DNS] resolve hook.example") {
+					return event.Payload
+				}
+			case <-time.After(100 * time.Millisecond):
+				return ""
+			}
+		}
+	}
+
+	_, _ = hookResolver(&failingResolver{err: errors.New("i/o timeout")}).LookupIPv4(context.Background(), "hook.example")
+	if payload := next(); payload != "[DNS] resolve hook.example A failed: i/o timeout" {
+		t.Fatalf("payload = %q", payload)
+	}
+	_, _ = hookResolver(&failingResolver{err: resolver.ErrIPNotFound}).LookupIPv4(context.Background(), "hook.example")
+	if payload := next(); payload != "" {
+		t.Fatalf("an empty answer was logged as a failure: %q", payload)
+	}
+	hooked := hookResolver(&failingResolver{})
+	if hookResolver(hooked) != hooked || hookResolver(nil) != nil {
+		t.Fatal("hookResolver wrapped a resolver twice")
+	}
+}
+
+func TestDnsEventsStayOutOfLogRecords(t *testing.T) {
+	logs.Start()
+	key := dnsPendingKey("ring.example", "A")
+	log.Debugln("[DNS] resolve ring.example A from udp://192.0.2.1:53")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dnsQueries.Lock()
+		_, ok := dnsQueries.pending[key]
+		dnsQueries.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("dns debug event did not reach the query log")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, record := range logs.Records() {
+		if strings.Contains(record.Payload, "ring.example") {
+			t.Fatalf("dns debug event stored in the log records: %+v", record)
+		}
+	}
+	log.Debugln("[DNS] resolve ring.example A failed: test done")
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"core/state"
+	"errors"
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/adapter/outboundgroup"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/tunnel"
+	"gopkg.in/yaml.v3"
+	"time"
+)
+
+// ExportConfigParams selects how the config is exported, ShareSafe falls
+// back to the share-safe setting of the redactor when unset.
+type ExportConfigParams struct {
+	ShareSafe *bool `json:"share-safe"`
+}
+
+// overlayRuleLines applies the rule overlay of the current profile to the
+// raw rule lines the same way applyRuleOverlay does to the parsed rules.
+// rules are the parsed lines, only lines without a parsed rule are parsed for
+// their keys.
+func overlayRuleLines(lines []string, rules []constant.Rule) []string {
+	keys := make([]string, len(lines))
+	for i, line := range lines {
+		if len(rules) == len(lines) {
+			keys[i] = ruleString(rules[i])
+		} else if rule, err := parseRuleLine(line); err == nil {
+			keys[i] = ruleString(rule)
+		}
+	}
+	entries := replayRuleOverlay(ruleOverlay.Items, keys, time.Now(), func(item *RuleOverlayItem) bool {
+		_, err := parseRuleLine(item.Rule)
+		return err == nil
+	})
+	result := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.item != nil {
+			result = append(result, entry.item.Rule)
+		} else {
+			result = append(result, lines[entry.base])
+		}
+	}
+	return append(appRuleLines(state.Get().AppAccessControl), result...)
+}
+
+// selectGroups moves the proxy selected at runtime to the front of every
+// select group, which is the proxy mihomo selects on load.
+func selectGroups(groups []any) {
+	proxies := tunnel.Proxies()
+	for _, item := range groups {
+		group, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		name, _ := group["name"].(string)
+		proxy, ok := proxies[name].(*adapter.Proxy)
+		if !ok {
+			continue
+		}
+		selector, ok := proxy.ProxyAdapter.(*outboundgroup.Selector)
+		if !ok {
+			continue
+		}
+		list, ok := group["proxies"].([]any)
+		if !ok {
+			continue
+		}
+		now := selector.Now()
+		for index, p := range list {
+			if p == now {
+				group["proxies"] = append([]any{p}, append(list[:index:index], list[index+1:]...)...)
+				break
+			}
+		}
+	}
+}
+
+func toYamlMap(value any) (map[string]any, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	mapping := map[string]any{}
+	if err = yaml.Unmarshal(data, &mapping); err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+// exportConfig serializes the running config, including updateConfig
+// patches, current selections and rule overlays, to clash yaml.
+func exportConfig(params *ExportConfigParams) (string, error) {
+	if currentConfig == nil || lastGoodSetupParams == nil {
+		return "", errors.New("config not applied")
+	}
+	mapping, err := rawConfigToMap(lastGoodSetupParams.Config)
+	if err != nil {
+		return "", err
+	}
+	general := currentConfig.General
+	mapping["port"] = general.Port
+	mapping["socks-port"] = general.SocksPort
+	mapping["redir-port"] = general.RedirPort
+	mapping["tproxy-port"] = general.TProxyPort
+	mapping["mixed-port"] = general.MixedPort
+	mapping["allow-lan"] = general.AllowLan
+	mapping["bind-address"] = general.BindAddress
+	mapping["mode"] = tunnel.Mode().String()
+	mapping["log-level"] = general.LogLevel.String()
+	mapping["ipv6"] = general.IPv6
+	mapping["unified-delay"] = general.UnifiedDelay
+	mapping["tcp-concurrent"] = general.TCPConcurrent
+	mapping["find-process-mode"] = string(general.FindProcessMode)
+	mapping["interface-name"] = general.Interface
+	mapping["external-controller"] = currentConfig.Controller.ExternalController
+	tun, err := toYamlMap(general.Tun)
+	if err != nil {
+		return "", err
+	}
+	if base, ok := mapping["tun"].(map[string]any); ok {
+		mergeMap(base, tun)
+	} else {
+		mapping["tun"] = tun
+	}
+	if groups, ok := mapping["proxy-groups"].([]any); ok {
+		selectGroups(groups)
+	}
+	mapping["rules"] = overlayRuleLines(lastGoodSetupParams.Config.Rule, currentConfig.Rules)
+	shareSafe := defaultRedactor.ShareSafe()
+	if params.ShareSafe != nil {
+		shareSafe = *params.ShareSafe
+	}
+	if shareSafe {
+		// redact the values rather than the yaml, a pattern must not break
+		// the quoting of the document
+		defaultRedactor.RedactConfig(mapping)
+		defaultRedactor.redactStrings(mapping)
+	}
+	data, err := yaml.Marshal(mapping)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
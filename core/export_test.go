@@ -0,0 +1,89 @@
+package main
+
+import (
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"testing"
+)
+
+func exportTestConfig(t *testing.T, shareSafe bool) map[string]any {
+	t.Helper()
+	runLock.Lock()
+	data, err := exportConfig(&ExportConfigParams{ShareSafe: &shareSafe})
+	runLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping := map[string]any{}
+	if err = yaml.Unmarshal([]byte(data), &mapping); err != nil {
+		t.Fatalf("exported config does not parse: %v\n%s", err, data)
+	}
+	return mapping
+}
+
+func TestExportConfig(t *testing.T) {
+	resetSetupTest(t)
+	runLock.Lock()
+	ruleOverlay = &RuleOverlay{Items: []*RuleOverlayItem{}}
+	runLock.Unlock()
+	params := defaultSetupParams()
+	params.Config.Proxy = []map[string]any{
+		{"name": "proxy", "type": "ss", "server": "127.0.0.1", "port": 8388, "cipher": "aes-128-gcm", "password": "hunter2"},
+	}
+	params.Config.ProxyGroup = []map[string]any{
+		{"name": "select", "type": "select", "proxies": []string{"DIRECT", "proxy"}},
+	}
+	params.Config.Rule = []string{"DOMAIN,example.com,DIRECT", "MATCH,select"}
+	params.SelectedMap = map[string]string{"select": "proxy"}
+	if result := setupConfig(params); !result.Applied {
+		t.Fatalf("setup = %+v", result)
+	}
+	updateConfig(decodeUpdateParams(t, `{"mode": "global", "allow-lan": true}`))
+	runLock.Lock()
+	_, err := insertRule(&InsertRuleParams{Rule: "DOMAIN,example.net,REJECT", Index: 1})
+	runLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapping := exportTestConfig(t, false)
+	if mapping["mode"] != "global" || mapping["allow-lan"] != true {
+		t.Fatalf("updates missing from the export: mode %v, allow-lan %v", mapping["mode"], mapping["allow-lan"])
+	}
+	rules := []any{"DOMAIN,example.com,DIRECT", "DOMAIN,example.net,REJECT", "MATCH,select"}
+	if !reflect.DeepEqual(mapping["rules"], rules) {
+		t.Fatalf("rules = %v, want %v", mapping["rules"], rules)
+	}
+	group := mapping["proxy-groups"].([]any)[0].(map[string]any)
+	if proxies := group["proxies"].([]any); proxies[0] != "proxy" || len(proxies) != 2 {
+		t.Fatalf("selected proxy not first in %v", proxies)
+	}
+	if proxy := mapping["proxies"].([]any)[0].(map[string]any); proxy["password"] != "hunter2" {
+		t.Fatalf("password changed without share-safe: %v", proxy["password"])
+	}
+
+	mapping = exportTestConfig(t, true)
+	if proxy := mapping["proxies"].([]any)[0].(map[string]any); proxy["password"] != redactedValue {
+		t.Fatalf("share-safe export kept the password: %v", proxy["password"])
+	}
+	if !reflect.DeepEqual(mapping["rules"], rules) {
+		t.Fatalf("share-safe rules = %v", mapping["rules"])
+	}
+}
+
+func TestSelectGroupsKeepsUnselected(t *testing.T) {
+	setupRuleTest(t, "MATCH,proxy")
+	groups := []any{
+		map[string]any{"name": "missing", "proxies": []any{"a", "b"}},
+		map[string]any{"name": "proxy", "proxies": []any{"a", "b"}},
+		"not a group",
+	}
+	runLock.Lock()
+	selectGroups(groups)
+	runLock.Unlock()
+	for _, item := range groups[:2] {
+		if proxies := item.(map[string]any)["proxies"]; !reflect.DeepEqual(proxies, []any{"a", "b"}) {
+			t.Fatalf("a group that is not a running selector changed to %v", proxies)
+		}
+	}
+}
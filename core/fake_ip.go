@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+	"github.com/metacubex/mihomo/component/fakeip"
+	"github.com/metacubex/mihomo/component/resolver"
+)
+
+func currentFakeIPPool() *fakeip.Pool {
+	if currentConfig == nil || currentConfig.DNS == nil || !resolver.FakeIPEnabled() {
+		return nil
+	}
+	return currentConfig.DNS.FakeIPRange
+}
+
+func resetFakeIPPool() error {
+	if currentFakeIPPool() == nil {
+		return errors.New("fake-ip not enabled")
+	}
+	return resolver.FlushFakeIP()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mihomoHttp "github.com/metacubex/mihomo/component/http"
+	"github.com/metacubex/mihomo/component/resource"
+	"github.com/metacubex/mihomo/constant"
+	cp "github.com/metacubex/mihomo/constant/provider"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const validatorsFileName = "validators.json"
+
+const providerDownloadTimeout = time.Minute
+
+type UpdateStatus string
+
+const (
+	UpdatedStatus     UpdateStatus = "updated"
+	NotModifiedStatus UpdateStatus = "not-modified"
+	FailedStatus      UpdateStatus = "failed"
+)
+
+type UpdateResult struct {
+	Name    string       `json:"name"`
+	Status  UpdateStatus `json:"status"`
+	Size    int64        `json:"size"`
+	Hash    string       `json:"hash"`
+	Message string       `json:"message,omitempty"`
+}
+
+func (result *UpdateResult) Json() string {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+type Validator struct {
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"last-modified"`
+	Size         int64     `json:"size"`
+	Hash         string    `json:"hash"`
+	ModTime      time.Time `json:"mod-time"`
+	CheckedAt    time.Time `json:"checked-at"`
+}
+
+type validatorStore struct {
+	sync.Mutex
+	validators map[string]Validator
+}
+
+var validators = &validatorStore{}
+
+func (s *validatorStore) path() string {
+	return constant.Path.Resolve(validatorsFileName)
+}
+
+func (s *validatorStore) load() {
+	if s.validators != nil {
+		return
+	}
+	s.validators = map[string]Validator{}
+	data, err := readFile(s.path())
+	if err != nil {
+		return
+	}
+	_ = json.Unmarshal(data, &s.validators)
+}
+
+func (s *validatorStore) Get(key string) (Validator, bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.load()
+	v, ok := s.validators[key]
+	return v, ok
+}
+
+func (s *validatorStore) Set(key string, v Validator) {
+	s.Lock()
+	defer s.Unlock()
+	s.load()
+	s.validators[key] = v
+	data, err := json.Marshal(s.validators)
+	if err != nil {
+		return
+	}
+	_ = safeWriteFile(s.path(), data)
+}
+
+// Save records v for the file at path together with its modification time,
+// so the hash is only computed again after the file changed.
+func (s *validatorStore) Save(path string, v Validator) {
+	if stat, err := os.Stat(path); err == nil {
+		v.ModTime = stat.ModTime()
+	}
+	s.Set(path, v)
+}
+
+type FetchedResource struct {
+	Data      []byte
+	Validator Validator
+	Modified  bool
+}
+
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hashFile(path string) (string, int64, error) {
+	data, err := readFile(path)
+	if err != nil {
+		return "", 0, err
+	}
+	return hashBytes(data), int64(len(data)), nil
+}
+
+// localFileHash returns the hash of the file at path, the recorded hash is
+// reused while the size and modification time of the file are unchanged.
+func localFileHash(path string) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if v, ok := validators.Get(path); ok && v.Hash != "" && v.Size == stat.Size() && v.ModTime.Equal(stat.ModTime()) {
+		return v.Hash, nil
+	}
+	hash, _, err := hashFile(path)
+	return hash, err
+}
+
+// conditionalFetch downloads url only when it differs from the copy at path.
+// Validators are only sent when the local file still matches the recorded hash,
+// so a file replaced out of band is always downloaded again.
+func conditionalFetch(ctx context.Context, url string, path string, proxy string) (*FetchedResource, error) {
+	header := http.Header{}
+	localHash, localErr := localFileHash(path)
+	if localErr == nil {
+		if v, ok := validators.Get(path); ok && v.Hash == localHash {
+			if v.ETag != "" {
+				header.Set("If-None-Match", v.ETag)
+			}
+			if v.LastModified != "" {
+				header.Set("If-Modified-Since", v.LastModified)
+			}
+		}
+	}
+	resp, err := mihomoHttp.HttpRequestWithProxy(ctx, url, http.MethodGet, header, nil, proxy)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && localErr == nil {
+		v, _ := validators.Get(path)
+		v.CheckedAt = time.Now()
+		validators.Save(path, v)
+		return &FetchedResource{Validator: v}, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errors.New(resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("no data")
+	}
+	if resp.ContentLength >= 0 && int64(len(data)) != resp.ContentLength {
+		return nil, fmt.Errorf("size mismatch: expected %d bytes, got %d", resp.ContentLength, len(data))
+	}
+	v := Validator{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Size:         int64(len(data)),
+		Hash:         hashBytes(data),
+		CheckedAt:    time.Now(),
+	}
+	return &FetchedResource{
+		Data:      data,
+		Validator: v,
+		Modified:  localErr != nil || v.Hash != localHash,
+	}, nil
+}
+
+// conditionalUpdateProvider refreshes a provider fetched over http with a
+// conditional request, other vehicles fall back to update. It reports whether
+// the content was unchanged.
+func conditionalUpdateProvider(vehicle cp.Vehicle, update func() (bool, error), sideUpdate func(data []byte) (bool, error)) (bool, error) {
+	httpVehicle, ok := vehicle.(*resource.HTTPVehicle)
+	if !ok {
+		return update()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), providerDownloadTimeout)
+	defer cancel()
+	path := httpVehicle.Path()
+	fetched, err := conditionalFetch(ctx, httpVehicle.Url(), path, httpVehicle.Proxy())
+	if err != nil {
+		return false, err
+	}
+	data := fetched.Data
+	if data == nil {
+		// not modified, the local copy only refreshes the update time
+		if data, err = readFile(path); err != nil {
+			return false, err
+		}
+	}
+	same, err := sideUpdate(data)
+	if err != nil {
+		return false, err
+	}
+	validators.Save(path, fetched.Validator)
+	return same || !fetched.Modified, nil
+}
+
+func writeTempFile(path string, data []byte) (string, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	temp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	tempPath := temp.Name()
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return "", err
+	}
+	return tempPath, nil
+}
+
+func safeWriteFile(path string, data []byte) error {
+	tempPath, err := writeTempFile(path, data)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		_ = os.Remove(tempPath)
+	}
+	return err
+}
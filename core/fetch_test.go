@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"github.com/metacubex/mihomo/constant"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testLastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// startTestProviderServer serves body with an ETag and a Last-Modified date
+// and answers matching conditional requests with 304. The returned slice
+// records the validators of every request.
+func startTestProviderServer(t *testing.T, body string) (string, *[]http.Header) {
+	t.Helper()
+	var requests []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Header.Clone())
+		if r.Header.Get("If-None-Match") == `"v1"` || r.Header.Get("If-Modified-Since") == testLastModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", testLastModified)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, &requests
+}
+
+func useTestHomeDir(t *testing.T) string {
+	t.Helper()
+	homeDir := constant.Path.HomeDir()
+	dir := t.TempDir()
+	constant.SetHomeDir(dir)
+	validators = &validatorStore{}
+	t.Cleanup(func() {
+		constant.SetHomeDir(homeDir)
+		validators = &validatorStore{}
+	})
+	return dir
+}
+
+func TestConditionalFetch(t *testing.T) {
+	path := filepath.Join(useTestHomeDir(t), "provider.yaml")
+	url, requests := startTestProviderServer(t, "proxies: []\n")
+	ctx := context.Background()
+
+	fetched, err := conditionalFetch(ctx, url, path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fetched.Modified || string(fetched.Data) != "proxies: []\n" {
+		t.Fatalf("first fetch = %+v", fetched)
+	}
+	if header := (*requests)[0]; header.Get("If-None-Match") != "" || header.Get("If-Modified-Since") != "" {
+		t.Fatalf("first request sent validators %v", header)
+	}
+	if err := os.WriteFile(path, fetched.Data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	validators.Save(path, fetched.Validator)
+
+	fetched, err = conditionalFetch(ctx, url, path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched.Modified || fetched.Data != nil {
+		t.Fatalf("conditional fetch = %+v, want not modified", fetched)
+	}
+	header := (*requests)[1]
+	if header.Get("If-None-Match") != `"v1"` || header.Get("If-Modified-Since") != testLastModified {
+		t.Fatalf("conditional request sent %v", header)
+	}
+
+	// a file replaced out of band no longer matches the recorded hash
+	if err := os.WriteFile(path, []byte("proxies: [edited]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fetched, err = conditionalFetch(ctx, url, path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fetched.Modified || string(fetched.Data) != "proxies: []\n" {
+		t.Fatalf("fetch after local edit = %+v", fetched)
+	}
+	if header := (*requests)[2]; header.Get("If-None-Match") != "" || header.Get("If-Modified-Since") != "" {
+		t.Fatalf("request after local edit sent validators %v", header)
+	}
+}
+
+func TestLocalFileHashCache(t *testing.T) {
+	path := filepath.Join(useTestHomeDir(t), "geoip.dat")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	validators.Save(path, Validator{Size: 4, Hash: "recorded"})
+	if hash, err := localFileHash(path); err != nil || hash != "recorded" {
+		t.Fatalf("localFileHash = %q, %v, want the recorded hash", hash, err)
+	}
+	if err := os.WriteFile(path, []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := localFileHash(path); err != nil || hash != hashBytes([]byte("changed")) {
+		t.Fatalf("localFileHash = %q, %v after the file changed", hash, err)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/component/geodata"
+	"github.com/metacubex/mihomo/component/geodata/router"
+	"github.com/metacubex/mihomo/component/mmdb"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/oschwald/maxminddb-golang"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	geoTypeMMDB    = "MMDB"
+	geoTypeASN     = "ASN"
+	geoTypeGeoIp   = "GeoIp"
+	geoTypeGeoSite = "GeoSite"
+)
+
+const geoDownloadTimeout = time.Minute * 5
+
+func geoDataUrl(geoType string) (string, error) {
+	switch geoType {
+	case geoTypeMMDB:
+		return geodata.MmdbUrl(), nil
+	case geoTypeASN:
+		return geodata.ASNUrl(), nil
+	case geoTypeGeoIp:
+		return geodata.GeoIpUrl(), nil
+	case geoTypeGeoSite:
+		return geodata.GeoSiteUrl(), nil
+	default:
+		return "", fmt.Errorf("unknown geo type %s", geoType)
+	}
+}
+
+func verifyGeoData(geoType string, path string, data []byte) error {
+	switch geoType {
+	case geoTypeMMDB, geoTypeASN:
+		if !mmdb.Verify(path) {
+			return fmt.Errorf("invalid %s database file", geoType)
+		}
+	case geoTypeGeoIp:
+		loader, err := geodata.GetGeoDataLoader("standard")
+		if err != nil {
+			return err
+		}
+		if _, err = loader.LoadIPByBytes(data, "cn"); err != nil {
+			return fmt.Errorf("invalid GeoIP database file: %s", err)
+		}
+	case geoTypeGeoSite:
+		loader, err := geodata.GetGeoDataLoader("standard")
+		if err != nil {
+			return err
+		}
+		if _, err = loader.LoadSiteByBytes(data, "cn"); err != nil {
+			return fmt.Errorf("invalid GeoSite database file: %s", err)
+		}
+	}
+	return nil
+}
+
+func geoDataBackupPath(path string) string {
+	return path + ".bak"
+}
+
+func reloadGeoData(geoType string) {
+	switch geoType {
+	case geoTypeMMDB:
+		mmdb.ReloadIP()
+	case geoTypeASN:
+		mmdb.ReloadASN()
+	case geoTypeGeoIp:
+		geodata.ClearGeoIPCache()
+	case geoTypeGeoSite:
+		geodata.ClearGeoSiteCache()
+	}
+}
+
+type geoFileVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+func statGeoFile(path string) (geoFileVersion, bool) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return geoFileVersion{}, false
+	}
+	return geoFileVersion{size: stat.Size(), modTime: stat.ModTime()}, true
+}
+
+var (
+	mmdbLoadsLock  sync.Mutex
+	mmdbLoadsCache = map[string]geoFileVersion{}
+)
+
+// mmdbLoads reports whether the database at path opens, the mmdb singletons
+// exit the process when they fail to load, so check before touching them.
+func mmdbLoads(path string) bool {
+	version, ok := statGeoFile(path)
+	if !ok {
+		return false
+	}
+	mmdbLoadsLock.Lock()
+	defer mmdbLoadsLock.Unlock()
+	if cached, ok := mmdbLoadsCache[path]; ok && cached == version {
+		return true
+	}
+	if !mmdb.Verify(path) {
+		return false
+	}
+	mmdbLoadsCache[path] = version
+	return true
+}
+
+// releaseGeoData closes the loaded reader for path, mmdb is loaded with mmap,
+// so it needs to be closed before overwriting the file. The lock must be held.
+func releaseGeoData(geoType string, path string) {
+	if !mmdbLoads(path) {
+		return
+	}
+	switch geoType {
+	case geoTypeMMDB:
+		if path == constant.Path.MMDB() {
+			_ = mmdb.IPInstance().Reader.Close()
+		}
+	case geoTypeASN:
+		if path == constant.Path.ASN() {
+			_ = mmdb.ASNInstance().Reader.Close()
+		}
+	}
+}
+
+// installGeoData verifies data in a temporary file next to path and only then
+// moves it into place, so a broken download never replaces a working database.
+// The replaced file is kept as a backup and restored if the new one fails to load.
+// The lock must be held.
+func installGeoData(geoType string, path string, data []byte) error {
+	tempPath, err := writeTempFile(path, data)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tempPath)
+	}()
+	if err = verifyGeoData(geoType, tempPath, data); err != nil {
+		return err
+	}
+	releaseGeoData(geoType, path)
+	defer reloadGeoData(geoType)
+	backupPath := geoDataBackupPath(path)
+	hasBackup := os.Rename(path, backupPath) == nil
+	if err = os.Rename(tempPath, path); err != nil {
+		if hasBackup {
+			_ = os.Rename(backupPath, path)
+		}
+		return err
+	}
+	if info := inspectGeoData(geoType, path, true); !info.IsValid() {
+		if !hasBackup {
+			return errors.New(info.Error)
+		}
+		if err = os.Rename(backupPath, path); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s, previous copy restored", info.Error)
+	}
+	return nil
+}
+
+// rollbackGeoData restores the previous copy, the lock must be held.
+func rollbackGeoData(params *UpdateGeoDataParams) error {
+	path := constant.Path.Resolve(params.GeoName)
+	backupPath := geoDataBackupPath(path)
+	if _, err := os.Stat(backupPath); err != nil {
+		return errors.New("no previous copy")
+	}
+	if info := inspectGeoData(params.GeoType, backupPath, true); !info.IsValid() {
+		return fmt.Errorf("previous copy is invalid: %s", info.Error)
+	}
+	releaseGeoData(params.GeoType, path)
+	defer reloadGeoData(params.GeoType)
+	_ = os.Remove(path + ".tmp")
+	if err := os.Rename(path, path+".tmp"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(backupPath, path); err != nil {
+		_ = os.Rename(path+".tmp", path)
+		return err
+	}
+	_ = os.Rename(path+".tmp", backupPath)
+	return nil
+}
+
+func updateGeoData(params *UpdateGeoDataParams) *UpdateResult {
+	result := &UpdateResult{
+		Name: params.GeoName,
+	}
+	fail := func(err error) *UpdateResult {
+		result.Status = FailedStatus
+		result.Message = err.Error()
+		return result
+	}
+	url, err := geoDataUrl(params.GeoType)
+	if err != nil {
+		return fail(err)
+	}
+	path := constant.Path.Resolve(params.GeoName)
+	ctx, cancel := context.WithTimeout(context.Background(), geoDownloadTimeout)
+	defer cancel()
+	fetched, err := conditionalFetch(ctx, url, path, "")
+	if err != nil {
+		return fail(fmt.Errorf("can't download %s database file: %w", params.GeoType, err))
+	}
+	result.Size = fetched.Validator.Size
+	result.Hash = fetched.Validator.Hash
+	if params.Hash != "" && params.Hash != fetched.Validator.Hash {
+		return fail(errors.New("hash mismatch"))
+	}
+	if !fetched.Modified {
+		validators.Save(path, fetched.Validator)
+		result.Status = NotModifiedStatus
+		return result
+	}
+	runLock.Lock()
+	err = installGeoData(params.GeoType, path, fetched.Data)
+	runLock.Unlock()
+	if err != nil {
+		return fail(err)
+	}
+	validators.Save(path, fetched.Validator)
+	result.Status = UpdatedStatus
+	return result
+}
+
+type GeoDataInfo struct {
+	Type      string     `json:"type"`
+	Name      string     `json:"name"`
+	Path      string     `json:"path"`
+	Exist     bool       `json:"exist"`
+	Size      int64      `json:"size"`
+	ModTime   time.Time  `json:"mod-time"`
+	BuildAt   *time.Time `json:"build-at"`
+	Entries   int        `json:"entries"`
+	Records   int        `json:"records"`
+	Nodes     int        `json:"nodes"`
+	Verified  bool       `json:"verified"`
+	Valid     *bool      `json:"valid"`
+	Error     string     `json:"error,omitempty"`
+	HasBackup bool       `json:"has-backup"`
+}
+
+// setValid records the outcome of an inspection, Valid stays nil while the
+// file was not verified and no error was found.
+func (info *GeoDataInfo) setValid(valid bool) {
+	info.Valid = &valid
+}
+
+func (info *GeoDataInfo) IsValid() bool {
+	return info.Valid != nil && *info.Valid
+}
+
+func geoDataPaths() map[string]string {
+	return map[string]string{
+		geoTypeMMDB:    constant.Path.MMDB(),
+		geoTypeASN:     constant.Path.ASN(),
+		geoTypeGeoIp:   constant.Path.GeoIP(),
+		geoTypeGeoSite: constant.Path.GeoSite(),
+	}
+}
+
+// inspectGeoData reads the metadata of the database at path. When deep is set
+// the whole file is verified, otherwise only the mmdb header is read and the
+// geodata counts come from the last deep inspection of the same file. The
+// validity of a file that was not verified is reported as unknown.
+func inspectGeoData(geoType string, path string, deep bool) *GeoDataInfo {
+	info := &GeoDataInfo{
+		Type: geoType,
+		Name: filepath.Base(path),
+		Path: path,
+	}
+	if _, err := os.Stat(geoDataBackupPath(path)); err == nil {
+		info.HasBackup = true
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		info.Error = err.Error()
+		info.setValid(false)
+		return info
+	}
+	info.Exist = true
+	info.Size = stat.Size()
+	info.ModTime = stat.ModTime()
+	switch geoType {
+	case geoTypeMMDB, geoTypeASN:
+		err = inspectMMDB(info, deep)
+	case geoTypeGeoIp:
+		err = inspectGeoList(info, deep, inspectGeoIP)
+	case geoTypeGeoSite:
+		err = inspectGeoList(info, deep, inspectGeoSite)
+	default:
+		err = fmt.Errorf("unknown geo type %s", geoType)
+	}
+	if err != nil {
+		info.Error = err.Error()
+		info.setValid(false)
+		return info
+	}
+	if info.Verified {
+		info.setValid(true)
+	}
+	return info
+}
+
+func inspectMMDB(info *GeoDataInfo, deep bool) error {
+	reader, err := maxminddb.Open(info.Path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	buildAt := time.Unix(int64(reader.Metadata.BuildEpoch), 0)
+	info.BuildAt = &buildAt
+	info.Nodes = int(reader.Metadata.NodeCount)
+	info.Verified = deep
+	if deep {
+		return reader.Verify()
+	}
+	return nil
+}
+
+type geoListInspection struct {
+	version geoFileVersion
+	entries int
+	records int
+}
+
+var (
+	geoListLock        sync.Mutex
+	geoListInspections = map[string]geoListInspection{}
+)
+
+// inspectGeoList parses a geodata file only when deep is set, the counts of
+// the last parse are reused while the file is unchanged. A file that was
+// never parsed is left unverified.
+func inspectGeoList(info *GeoDataInfo, deep bool, inspect func(info *GeoDataInfo) error) error {
+	version, _ := statGeoFile(info.Path)
+	geoListLock.Lock()
+	cached, ok := geoListInspections[info.Path]
+	geoListLock.Unlock()
+	if ok && cached.version == version {
+		info.Entries = cached.entries
+		info.Records = cached.records
+		info.Verified = true
+		return nil
+	}
+	if !deep {
+		return nil
+	}
+	if err := inspect(info); err != nil {
+		return err
+	}
+	info.Verified = true
+	geoListLock.Lock()
+	geoListInspections[info.Path] = geoListInspection{
+		version: version,
+		entries: info.Entries,
+		records: info.Records,
+	}
+	geoListLock.Unlock()
+	return nil
+}
+
+func inspectGeoIP(info *GeoDataInfo) error {
+	data, err := readFile(info.Path)
+	if err != nil {
+		return err
+	}
+	var list router.GeoIPList
+	if err = proto.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	if len(list.Entry) == 0 {
+		return errors.New("no entries")
+	}
+	info.Entries = len(list.Entry)
+	for _, entry := range list.Entry {
+		info.Records += len(entry.Cidr)
+	}
+	return nil
+}
+
+func inspectGeoSite(info *GeoDataInfo) error {
+	data, err := readFile(info.Path)
+	if err != nil {
+		return err
+	}
+	var list router.GeoSiteList
+	if err = proto.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	if len(list.Entry) == 0 {
+		return errors.New("no entries")
+	}
+	info.Entries = len(list.Entry)
+	for _, entry := range list.Entry {
+		info.Records += len(entry.Domain)
+	}
+	return nil
+}
+
+func getGeoDataInventory(deep bool) []*GeoDataInfo {
+	paths := geoDataPaths()
+	infos := make([]*GeoDataInfo, 0, len(paths))
+	for _, geoType := range []string{geoTypeMMDB, geoTypeASN, geoTypeGeoIp, geoTypeGeoSite} {
+		infos = append(infos, inspectGeoData(geoType, paths[geoType], deep))
+	}
+	return infos
+}
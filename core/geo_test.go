@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"github.com/metacubex/mihomo/component/geodata/router"
+	"github.com/metacubex/mihomo/constant"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"testing"
+)
+
+func testGeoSite(t *testing.T, domains ...string) []byte {
+	t.Helper()
+	site := &router.GeoSite{CountryCode: "CN"}
+	for _, domain := range domains {
+		site.Domain = append(site.Domain, &router.Domain{Type: router.Domain_Domain, Value: domain})
+	}
+	data, err := proto.Marshal(&router.GeoSiteList{Entry: []*router.GeoSite{site}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func readTestFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestInstallAndRollbackGeoData(t *testing.T) {
+	useTestHomeDir(t)
+	params := &UpdateGeoDataParams{GeoType: geoTypeGeoSite, GeoName: "GeoSite.dat"}
+	path := constant.Path.Resolve(params.GeoName)
+	first := testGeoSite(t, "example.cn")
+	second := testGeoSite(t, "example.cn", "example.com.cn")
+	if err := os.WriteFile(path, first, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := installGeoData(params.GeoType, path, second); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readTestFile(t, path), second) || !bytes.Equal(readTestFile(t, geoDataBackupPath(path)), first) {
+		t.Fatal("install did not keep the replaced file as backup")
+	}
+
+	if err := installGeoData(params.GeoType, path, []byte("broken")); err == nil {
+		t.Fatal("installed a broken database")
+	}
+	if !bytes.Equal(readTestFile(t, path), second) {
+		t.Fatal("a broken download replaced the database")
+	}
+
+	if err := rollbackGeoData(params); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readTestFile(t, path), first) || !bytes.Equal(readTestFile(t, geoDataBackupPath(path)), second) {
+		t.Fatal("rollback did not swap the database with its backup")
+	}
+
+	if err := os.WriteFile(geoDataBackupPath(path), []byte("broken"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := rollbackGeoData(params); err == nil {
+		t.Fatal("rolled back to a broken copy")
+	}
+	if !bytes.Equal(readTestFile(t, path), first) {
+		t.Fatal("a failed rollback replaced the database")
+	}
+}
+
+func TestInspectGeoDataValidity(t *testing.T) {
+	useTestHomeDir(t)
+	path := constant.Path.Resolve("GeoSite.dat")
+	if err := os.WriteFile(path, testGeoSite(t, "example.cn", "example.org"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if info := inspectGeoData(geoTypeGeoSite, path, false); info.Valid != nil || info.Verified {
+		t.Fatalf("quick inspection of an unparsed file = %+v, want unknown validity", info)
+	}
+	info := inspectGeoData(geoTypeGeoSite, path, true)
+	if !info.IsValid() || info.Entries != 1 || info.Records != 2 {
+		t.Fatalf("deep inspection = %+v", info)
+	}
+	if info := inspectGeoData(geoTypeGeoSite, path, false); !info.IsValid() || info.Records != 2 {
+		t.Fatalf("quick inspection after a deep one = %+v", info)
+	}
+
+	if err := os.WriteFile(path, []byte("broken!"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if info := inspectGeoData(geoTypeGeoSite, path, true); info.Valid == nil || *info.Valid || info.Error == "" {
+		t.Fatalf("deep inspection of a broken file = %+v", info)
+	}
+	if info := inspectGeoData(geoTypeGeoSite, constant.Path.Resolve("missing.dat"), false); info.Valid == nil || *info.Valid {
+		t.Fatalf("inspection of a missing file = %+v", info)
+	}
+}
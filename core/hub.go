@@ -7,30 +7,33 @@ import (
 	"fmt"
 	"github.com/metacubex/mihomo/adapter"
 	"github.com/metacubex/mihomo/adapter/outboundgroup"
-	"github.com/metacubex/mihomo/common/observable"
+	"github.com/metacubex/mihomo/adapter/provider"
 	"github.com/metacubex/mihomo/common/utils"
 	"github.com/metacubex/mihomo/component/mmdb"
 	"github.com/metacubex/mihomo/component/resolver"
-	"github.com/metacubex/mihomo/component/updater"
 	"github.com/metacubex/mihomo/config"
 	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/constant/features"
 	cp "github.com/metacubex/mihomo/constant/provider"
 	"github.com/metacubex/mihomo/hub/executor"
 	"github.com/metacubex/mihomo/listener"
 	"github.com/metacubex/mihomo/log"
+	rp "github.com/metacubex/mihomo/rules/provider"
 	"github.com/metacubex/mihomo/tunnel"
 	"github.com/metacubex/mihomo/tunnel/statistic"
 	"net"
+	"reflect"
 	"runtime"
 	"sort"
 	"strconv"
 	"time"
 )
 
+const stateFileName = "state.json"
+
 var (
 	isInit            = false
 	externalProviders = map[string]cp.Provider{}
-	logSubscriber     observable.Subscription[log.Event]
 )
 
 func handleInitClash(paramsString string) bool {
@@ -42,8 +45,11 @@ func handleInitClash(paramsString string) bool {
 	version = params.Version
 	if !isInit {
 		constant.SetHomeDir(params.HomeDir)
+		loadState()
+		logFile.Load()
 		isInit = true
 	}
+	logs.Start()
 	return isInit
 }
 
@@ -61,6 +67,9 @@ func handleStopListener() bool {
 	defer runLock.Unlock()
 	isRunning = false
 	listener.StopListener()
+	if !features.Android {
+		tunStatus.Refresh(false, nil)
+	}
 	return true
 }
 
@@ -78,6 +87,7 @@ func handleForceGc() {
 func handleShutdown() bool {
 	stopListeners()
 	executor.Shutdown()
+	currentRawConfig = nil
 	runtime.GC()
 	isInit = false
 	return true
@@ -91,6 +101,10 @@ func handleValidateConfig(bytes []byte) string {
 	return ""
 }
 
+func handleDiagnoseConfig(bytes []byte) *ValidateResult {
+	return diagnoseConfig(bytes)
+}
+
 func handleGetProxies() map[string]constant.Proxy {
 	runLock.Lock()
 	defer runLock.Unlock()
@@ -137,7 +151,7 @@ func handleChangeProxy(data string, fn func(string string)) {
 }
 
 func handleGetTraffic() string {
-	up, down := statistic.DefaultManager.Current(state.CurrentState.OnlyStatisticsProxy)
+	up, down := statistic.DefaultManager.Current(state.Get().OnlyStatisticsProxy)
 	traffic := map[string]int64{
 		"up":   up,
 		"down": down,
@@ -151,7 +165,7 @@ func handleGetTraffic() string {
 }
 
 func handleGetTotalTraffic() string {
-	up, down := statistic.DefaultManager.Total(state.CurrentState.OnlyStatisticsProxy)
+	up, down := statistic.DefaultManager.Total(state.Get().OnlyStatisticsProxy)
 	traffic := map[string]int64{
 		"up":   up,
 		"down": down,
@@ -307,52 +321,104 @@ func handleGetExternalProvider(externalProviderName string) string {
 	return string(data)
 }
 
-func handleUpdateGeoData(geoType string, geoName string, fn func(value string)) {
+func handleUpdateGeoData(params *UpdateGeoDataParams, fn func(value string)) {
 	go func() {
-		path := constant.Path.Resolve(geoName)
-		switch geoType {
-		case "MMDB":
-			err := updater.UpdateMMDBWithPath(path)
-			if err != nil {
-				fn(err.Error())
-				return
-			}
-		case "ASN":
-			err := updater.UpdateASNWithPath(path)
-			if err != nil {
-				fn(err.Error())
-				return
-			}
-		case "GeoIp":
-			err := updater.UpdateGeoIpWithPath(path)
-			if err != nil {
-				fn(err.Error())
-				return
-			}
-		case "GeoSite":
-			err := updater.UpdateGeoSiteWithPath(path)
-			if err != nil {
-				fn(err.Error())
-				return
-			}
-		}
-		fn("")
+		fn(updateGeoData(params).Message)
 	}()
 }
 
-func handleUpdateExternalProvider(providerName string, fn func(value string)) {
+func handleConditionalUpdateGeoData(params *UpdateGeoDataParams, fn func(value string)) {
 	go func() {
-		externalProvider, exist := externalProviders[providerName]
-		if !exist {
-			fn("external provider is not exist")
-			return
-		}
-		err := externalProvider.Update()
+		fn(updateGeoData(params).Json())
+	}()
+}
+
+func handleGetGeoDataInventory() string {
+	data, err := json.Marshal(getGeoDataInventory(false))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleVerifyGeoData(fn func(value string)) {
+	go func() {
+		data, err := json.Marshal(getGeoDataInventory(true))
 		if err != nil {
-			fn(err.Error())
+			fn("")
 			return
 		}
-		fn("")
+		fn(string(data))
+	}()
+}
+
+func handleRollbackGeoData(params *UpdateGeoDataParams) string {
+	runLock.Lock()
+	defer runLock.Unlock()
+	err := rollbackGeoData(params)
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func updateExternalProvider(providerName string) *UpdateResult {
+	result := &UpdateResult{
+		Name: providerName,
+	}
+	externalProvider, exist := externalProviders[providerName]
+	if !exist {
+		result.Status = FailedStatus
+		result.Message = "external provider is not exist"
+		return result
+	}
+	var same bool
+	var err error
+	switch p := externalProvider.(type) {
+	case *provider.ProxySetProvider:
+		same, err = conditionalUpdateProvider(p.Vehicle(), func() (bool, error) {
+			_, same, err := p.Fetcher.Update()
+			return same, err
+		}, func(data []byte) (bool, error) {
+			_, same, err := p.Fetcher.SideUpdate(data)
+			return same, err
+		})
+	case *rp.RuleSetProvider:
+		same, err = conditionalUpdateProvider(p.Vehicle(), func() (bool, error) {
+			_, same, err := p.Fetcher.Update()
+			return same, err
+		}, func(data []byte) (bool, error) {
+			_, same, err := p.Fetcher.SideUpdate(data)
+			return same, err
+		})
+	default:
+		err = externalProvider.Update()
+	}
+	if err != nil {
+		result.Status = FailedStatus
+		result.Message = err.Error()
+		return result
+	}
+	if same {
+		result.Status = NotModifiedStatus
+	} else {
+		result.Status = UpdatedStatus
+	}
+	if e, err := toExternalProvider(externalProvider); err == nil {
+		result.Hash, result.Size, _ = hashFile(e.Path)
+	}
+	return result
+}
+
+func handleUpdateExternalProvider(providerName string, fn func(value string)) {
+	go func() {
+		fn(updateExternalProvider(providerName).Message)
+	}()
+}
+
+func handleConditionalUpdateExternalProvider(providerName string, fn func(value string)) {
+	go func() {
+		fn(updateExternalProvider(providerName).Json())
 	}()
 }
 
@@ -375,30 +441,118 @@ func handleSideLoadExternalProvider(providerName string, data []byte, fn func(va
 }
 
 func handleStartLog() {
-	if logSubscriber != nil {
-		log.UnSubscribe(logSubscriber)
-		logSubscriber = nil
+	logs.Subscribe(defaultLogSubscription, nil)
+}
+
+func handleStopLog() {
+	logs.UnSubscribe(defaultLogSubscription)
+}
+
+func handleQueryLogs(paramsString string) []*LogRecord {
+	var params = &QueryLogsParams{}
+	err := json.Unmarshal([]byte(paramsString), params)
+	if err != nil {
+		return []*LogRecord{}
+	}
+	return queryLogs(params)
+}
+
+func handleSubscribeLog(paramsString string) string {
+	var params = &SubscribeLogParams{
+		Level: log.INFO,
+	}
+	err := json.Unmarshal([]byte(paramsString), params)
+	if err != nil {
+		return ""
+	}
+	return subscribeLog(params)
+}
+
+func handleUnsubscribeLog(id string) bool {
+	return logs.UnSubscribe(id)
+}
+
+func handleSetLogFile(paramsString string) string {
+	var params = &LogFileParams{
+		Level: log.INFO,
+	}
+	err := json.Unmarshal([]byte(paramsString), params)
+	if err != nil {
+		return err.Error()
+	}
+	err = logFile.Update(params)
+	logs.RefreshLevel()
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func handleQueryDns(paramsString string) []*DnsQuery {
+	var params = &QueryDnsParams{}
+	err := json.Unmarshal([]byte(paramsString), params)
+	if err != nil {
+		return []*DnsQuery{}
+	}
+	return queryDns(params)
+}
+
+func handleSubscribeDns() string {
+	return dnsQueries.Subscribe()
+}
+
+func handleUnsubscribeDns(id string) bool {
+	return dnsQueries.UnSubscribe(id)
+}
+
+func handleGetDnsStats() *DnsStats {
+	return dnsQueries.Stats()
+}
+
+func handleResetFakeIPPool() string {
+	runLock.Lock()
+	defer runLock.Unlock()
+	err := resetFakeIPPool()
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func handleBenchmarkDns(paramsString string, fn func(value string, err error)) {
+	var params = &DnsBenchmarkParams{}
+	err := json.Unmarshal([]byte(paramsString), params)
+	if err != nil {
+		fn("", err)
+		return
 	}
-	logSubscriber = log.Subscribe()
 	go func() {
-		for logData := range logSubscriber {
-			if logData.LogLevel < log.Level() {
-				continue
-			}
-			message := &Message{
-				Type: LogMessage,
-				Data: logData,
-			}
-			sendMessage(*message)
+		result, err := benchmarkDns(params)
+		if err != nil {
+			log.Warnln("[DNS] benchmark error: %v", err)
+			fn("", err)
+			return
 		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		fn(string(data), nil)
 	}()
 }
 
-func handleStopLog() {
-	if logSubscriber != nil {
-		log.UnSubscribe(logSubscriber)
-		logSubscriber = nil
+func handleCreateDiagnosticsBundle() string {
+	bundle, err := createDiagnosticsBundle()
+	if err != nil {
+		log.Errorln("[Diagnostics] create bundle error: %v", err)
+		return ""
+	}
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return ""
 	}
+	return string(data)
 }
 
 func handleGetCountryCode(ip string, fn func(value string)) {
@@ -414,14 +568,237 @@ func handleGetCountryCode(ip string, fn func(value string)) {
 	}()
 }
 
+func handleLookup(query string, fn func(value string)) {
+	go func() {
+		data, err := json.Marshal(lookup(query))
+		if err != nil {
+			fn("")
+			return
+		}
+		fn(string(data))
+	}()
+}
+
+func handleExplainRule(paramsString string) (*ExplainResult, error) {
+	var params = &ExplainRuleParams{}
+	err := json.Unmarshal([]byte(paramsString), params)
+	if err != nil {
+		return nil, err
+	}
+	return explainRule(params)
+}
+
+func handleGetRuleStats(paramsString string) string {
+	runLock.Lock()
+	defer runLock.Unlock()
+	var params = &RuleStatsParams{}
+	if paramsString != "" {
+		err := json.Unmarshal([]byte(paramsString), params)
+		if err != nil {
+			return ""
+		}
+	}
+	data, err := json.Marshal(getRuleStats(params))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleResetRuleStats() {
+	ruleStats.Reset()
+}
+
+func handleGetUnusedRules(paramsString string) string {
+	runLock.Lock()
+	defer runLock.Unlock()
+	var params = &UnusedRulesParams{}
+	if paramsString != "" {
+		err := json.Unmarshal([]byte(paramsString), params)
+		if err != nil {
+			return ""
+		}
+	}
+	data, err := json.Marshal(getUnusedRules(params))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleInsertRule(paramsString string, override bool) (string, error) {
+	runLock.Lock()
+	defer runLock.Unlock()
+	var params = &InsertRuleParams{}
+	err := json.Unmarshal([]byte(paramsString), params)
+	if err != nil {
+		return "", err
+	}
+	if override {
+		return overrideRule(params)
+	}
+	return insertRule(params)
+}
+
+func handleRemoveRule(paramsString string) string {
+	runLock.Lock()
+	defer runLock.Unlock()
+	var params = &RemoveRuleParams{}
+	err := json.Unmarshal([]byte(paramsString), params)
+	if err != nil {
+		return err.Error()
+	}
+	err = removeRule(params)
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func handleMoveRule(paramsString string) string {
+	runLock.Lock()
+	defer runLock.Unlock()
+	var params = &MoveRuleParams{}
+	err := json.Unmarshal([]byte(paramsString), params)
+	if err != nil {
+		return err.Error()
+	}
+	err = moveRule(params)
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func handleGetRuleOverlay() string {
+	runLock.Lock()
+	defer runLock.Unlock()
+	data, err := json.Marshal(ruleOverlay)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleDeleteRuleOverlayItem(id string) string {
+	runLock.Lock()
+	defer runLock.Unlock()
+	err := deleteRuleOverlayItem(id)
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func handleClearRuleOverlay() string {
+	runLock.Lock()
+	defer runLock.Unlock()
+	err := clearRuleOverlay()
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
 func handleGetMemory(fn func(value string)) {
 	go func() {
 		fn(strconv.FormatUint(statistic.DefaultManager.Memory(), 10))
 	}()
 }
 
+// loadState loads the persisted state, the changes set before are kept and
+// saved on top of it.
+func loadState() {
+	data, err := readFile(constant.Path.Resolve(stateFileName))
+	if err != nil {
+		data = nil
+	}
+	replayed, err := state.Load(data)
+	if err != nil {
+		log.Warnln("[State] load error: %v", err)
+	}
+	if replayed {
+		saveState(state.Get())
+	}
+}
+
+func saveState(current state.State) {
+	data, err := json.Marshal(current)
+	if err == nil {
+		err = safeWriteFile(constant.Path.Resolve(stateFileName), data)
+	}
+	if err != nil {
+		log.Warnln("[State] save error: %v", err)
+	}
+}
+
+// updateState applies the state patch and reapplies the rules when the app
+// access control changed.
+func updateState(params string) error {
+	previous := state.Get()
+	current, err := state.Update([]byte(params))
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(previous.AppAccessControl, current.AppAccessControl) {
+		runLock.Lock()
+		applyRuleOverlay()
+		runLock.Unlock()
+	}
+	if !features.Android && previous.TunAddress != current.TunAddress {
+		runLock.Lock()
+		if isRunning && currentConfig != nil {
+			updateTun()
+		}
+		runLock.Unlock()
+	}
+	return nil
+}
+
 func handleSetState(params string) {
-	_ = json.Unmarshal([]byte(params), state.CurrentState)
+	if err := updateState(params); err != nil {
+		log.Warnln("[State] set error: %v", err)
+	}
+}
+
+func handleUpdateState(params string) string {
+	err := updateState(params)
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func handleStartTunListener() string {
+	err := setTunEnable(true)
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func handleStopTunListener() string {
+	err := setTunEnable(false)
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func handleGetTunStatus() string {
+	data, err := json.Marshal(tunStatus.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleGetState() string {
+	data, err := json.Marshal(state.Get())
+	if err != nil {
+		return ""
+	}
+	return string(data)
 }
 
 func handleGetConfig(path string) (*config.RawConfig, error) {
@@ -446,26 +823,132 @@ func handleUpdateConfig(bytes []byte) string {
 	if err != nil {
 		return err.Error()
 	}
-	updateConfig(params)
+	for _, result := range updateConfig(params) {
+		if !result.Success {
+			return result.Error
+		}
+	}
 	return ""
 }
 
-func handleSetupConfig(bytes []byte) string {
+func handlePatchConfig(bytes []byte) []*UpdateFieldResult {
+	var params = &UpdateParams{}
+	err := json.Unmarshal(bytes, params)
+	if err != nil {
+		return []*UpdateFieldResult{
+			{
+				Field: "params",
+				Error: err.Error(),
+			},
+		}
+	}
+	return updateConfig(params)
+}
+
+func handleApplyConfig(bytes []byte) *SetupResult {
 	var params = defaultSetupParams()
 	err := UnmarshalJson(bytes, params)
 	if err != nil {
 		log.Errorln("unmarshalRawConfig error %v", err)
-		_ = setupConfig(defaultSetupParams())
+		result := &SetupResult{
+			Stage: ParseSetupStage,
+			Error: err.Error(),
+		}
+		runLock.Lock()
+		rollbackIfUnset(result)
+		runLock.Unlock()
+		return result
+	}
+	return setupConfig(params)
+}
+
+func handleGetMergedConfig(paramsString string) (string, error) {
+	if paramsString == "" {
+		return getMergedConfig(nil)
+	}
+	var params = defaultSetupParams()
+	if err := UnmarshalJson([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	return getMergedConfig(params)
+}
+
+func handleExportConfig(paramsString string) (string, error) {
+	var params = &ExportConfigParams{}
+	err := json.Unmarshal([]byte(paramsString), params)
+	if err != nil {
+		return "", err
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	return exportConfig(params)
+}
+
+func handleSetRedaction(paramsString string) string {
+	var params = &RedactionParams{}
+	err := json.Unmarshal([]byte(paramsString), params)
+	if err != nil {
 		return err.Error()
 	}
-	err = setupConfig(params)
+	err = defaultRedactor.Update(params)
 	if err != nil {
 		return err.Error()
 	}
 	return ""
 }
 
+func handleGetRedaction() string {
+	data, err := json.Marshal(defaultRedactor.State())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleSetupConfig(bytes []byte) string {
+	return handleApplyConfig(bytes).Error
+}
+
 func init() {
+	state.ValidateHook = func(previous state.State, next state.State) error {
+		tunChanged := !reflect.DeepEqual(previous.TunAddress, next.TunAddress) || previous.VpnProps.Ipv6 != next.VpnProps.Ipv6
+		proxy := ""
+		if accessControl := next.AppAccessControl; accessControl != nil && accessControl.Enable {
+			proxy = accessControl.Proxy
+		}
+		if previous.AppAccessControl != nil && previous.AppAccessControl.Enable && previous.AppAccessControl.Proxy == proxy {
+			proxy = ""
+		}
+		if !reflect.DeepEqual(previous.AppAccessControl, next.AppAccessControl) {
+			if err := validateAppAccessControl(next.AppAccessControl); err != nil {
+				return err
+			}
+		}
+		if !tunChanged && proxy == "" {
+			return nil
+		}
+		runLock.Lock()
+		defer runLock.Unlock()
+		if currentConfig == nil {
+			return nil
+		}
+		if _, ok := tunnel.Proxies()[proxy]; proxy != "" && !ok {
+			return fmt.Errorf("app-access-control.proxy: proxy %s not found", proxy)
+		}
+		if !tunChanged {
+			return nil
+		}
+		return validateTunAddress(next, &currentConfig.General.Tun)
+	}
+	state.ChangeHook = func(current state.State) {
+		if isInit {
+			saveState(current)
+		}
+		sendMessage(Message{
+			Type: StateMessage,
+			Data: current,
+		})
+	}
 	adapter.UrlTestHook = func(url string, name string, delay uint16) {
 		delayData := &Delay{
 			Url:  url,
@@ -482,6 +965,7 @@ func init() {
 		})
 	}
 	statistic.DefaultRequestNotify = func(c statistic.Tracker) {
+		ruleStats.Record(c)
 		sendMessage(Message{
 			Type: RequestMessage,
 			Data: c,
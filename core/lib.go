@@ -72,7 +72,7 @@ func sendMessage(message Message) {
 	result := ActionResult{
 		Method: messageMethod,
 		Port:   messagePort,
-		Data:   message,
+		Data:   defaultRedactor.Message(message),
 	}
 	result.send()
 }
@@ -84,7 +84,7 @@ func getConfig(s *C.char) *C.char {
 	if err != nil {
 		return C.CString("")
 	}
-	marshal, err := json.Marshal(config)
+	marshal, err := json.Marshal(defaultRedactor.Data(config))
 	if err != nil {
 		return C.CString("")
 	}
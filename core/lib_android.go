@@ -110,7 +110,7 @@ func handleStartTun(fd int, callback unsafe.Pointer) {
 			limit:    semaphore.NewWeighted(4),
 		}
 		initTunHook()
-		tunListener, _ := t.Start(fd, currentConfig.General.Tun.Device, currentConfig.General.Tun.Stack)
+		tunListener, _ := t.Start(fd, currentConfig.General.Tun.Device, currentConfig.General.Tun.Stack, getTunMTU(state.Get()))
 		if tunListener != nil {
 			log.Infoln("TUN address: %v", tunListener.Address())
 			tunHandler.listener = tunListener
@@ -150,20 +150,33 @@ func removeTunHook() {
 	process.DefaultPackageNameResolver = nil
 }
 
+// getTunMTU prefers the mtu of the state over the one of the tun config.
+func getTunMTU(current state.State) uint32 {
+	if current.TunAddress.MTU != 0 {
+		return current.TunAddress.MTU
+	}
+	if currentConfig != nil && currentConfig.General.Tun.MTU != 0 {
+		return currentConfig.General.Tun.MTU
+	}
+	return current.MTU()
+}
+
 func handleGetAndroidVpnOptions() string {
 	tunLock.Lock()
 	defer tunLock.Unlock()
+	current := state.Get()
 	options := state.AndroidVpnOptions{
-		Enable:           state.CurrentState.VpnProps.Enable,
+		Enable:           current.VpnProps.Enable,
 		Port:             currentConfig.General.MixedPort,
-		Ipv4Address:      state.DefaultIpv4Address,
-		Ipv6Address:      state.GetIpv6Address(),
-		AccessControl:    state.CurrentState.VpnProps.AccessControl,
-		SystemProxy:      state.CurrentState.VpnProps.SystemProxy,
-		AllowBypass:      state.CurrentState.VpnProps.AllowBypass,
+		Ipv4Address:      current.Ipv4Address(),
+		Ipv6Address:      current.Ipv6Address(),
+		AccessControl:    current.VpnProps.AccessControl,
+		SystemProxy:      current.VpnProps.SystemProxy,
+		AllowBypass:      current.VpnProps.AllowBypass,
 		RouteAddress:     currentConfig.General.Tun.RouteAddress,
-		BypassDomain:     state.CurrentState.BypassDomain,
-		DnsServerAddress: state.GetDnsServerAddress(),
+		BypassDomain:     current.BypassDomain,
+		DnsServerAddress: current.DnsAddress(),
+		MTU:              getTunMTU(current),
 	}
 	data, err := json.Marshal(options)
 	if err != nil {
@@ -182,10 +195,7 @@ func handleUpdateDns(value string) {
 }
 
 func handleGetCurrentProfileName() string {
-	if state.CurrentState == nil {
-		return ""
-	}
-	return state.CurrentState.CurrentProfileName
+	return state.Get().CurrentProfileName
 }
 
 func nextHandle(action *Action, result ActionResult) bool {
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+type LogComponent string
+
+const (
+	DNSComponent      LogComponent = "dns"
+	TUNComponent      LogComponent = "tun"
+	ProviderComponent LogComponent = "provider"
+	RuleComponent     LogComponent = "rule"
+	DialerComponent   LogComponent = "dialer"
+)
+
+var logComponentPrefixes = map[string]LogComponent{
+	"DNS":        DNSComponent,
+	"DNS Server": DNSComponent,
+	"TUN":        TUNComponent,
+	"Provider":   ProviderComponent,
+	"GEO":        ProviderComponent,
+	"Rule":       RuleComponent,
+}
+
+var (
+	logPrefixRegexp = regexp.MustCompile(`^\[([^\]]+)\] `)
+	logFieldRegexp  = regexp.MustCompile(`(?:^|\s)([A-Za-z][\w-]*)=([^\s,]+)`)
+	// [TCP] 1.1.1.1:1234(process, uid=0) --> example.com:443 match DOMAIN(example.com) using Proxy[node]
+	logMatchRegexp = regexp.MustCompile(`^\[(TCP|UDP)\] (\S+?)(?:\(([^)]*)\))? --> (\S+) match (.+) using (.+)$`)
+	// [TCP] dial node (match DOMAIN/example.com) 1.1.1.1:1234 --> example.com:443 error: timeout
+	logDialRegexp = regexp.MustCompile(`^\[(TCP|UDP)\] dial (.+?) (?:\(match ([^)]*)\) )?(\S+?)(?:\(([^)]*)\))? --> (\S+) error: (.*)$`)
+)
+
+// parseLogPayload derives the component and fields from a mihomo log
+// payload, connection logs get the source and destination fields their
+// connection id is resolved from, see connectionIndex.
+//
+// This is best-effort parsing: mihomo logs plain text and owns the data, so
+// the results only hold for the message formats matched here, a changed
+// format leaves them empty rather than failing.
+func parseLogPayload(payload string) (LogComponent, map[string]string) {
+	fields := map[string]string{}
+	if match := logMatchRegexp.FindStringSubmatch(payload); match != nil {
+		fields["network"] = strings.ToLower(match[1])
+		fields["source"] = match[2]
+		if match[3] != "" {
+			fields["process"] = match[3]
+		}
+		fields["destination"] = match[4]
+		fields["rule"] = match[5]
+		fields["chain"] = match[6]
+		return RuleComponent, fields
+	}
+	if match := logDialRegexp.FindStringSubmatch(payload); match != nil {
+		fields["network"] = strings.ToLower(match[1])
+		fields["proxy"] = match[2]
+		if match[3] != "" {
+			fields["rule"] = match[3]
+		}
+		fields["source"] = match[4]
+		if match[5] != "" {
+			fields["process"] = match[5]
+		}
+		fields["destination"] = match[6]
+		fields["error"] = match[7]
+		return DialerComponent, fields
+	}
+	var component LogComponent
+	if match := logPrefixRegexp.FindStringSubmatch(payload); match != nil {
+		component = logComponentPrefixes[match[1]]
+	}
+	for _, match := range logFieldRegexp.FindAllStringSubmatch(payload, -1) {
+		fields[match[1]] = match[2]
+	}
+	if len(fields) == 0 {
+		fields = nil
+	}
+	return component, fields
+}
+
+// connectionIndex maps the source and destination of tracked connections to
+// their ids. mihomo has no hook for new connections, so a miss syncs the
+// index from the manager once per batch of records and only connections not
+// indexed yet have their addresses formatted.
+type connectionIndex struct {
+	sync.Mutex
+	ids  map[string]string
+	keys map[string]string
+}
+
+var connections = &connectionIndex{
+	ids:  map[string]string{},
+	keys: map[string]string{},
+}
+
+func connectionKey(source, destination string) string {
+	return source + " " + destination
+}
+
+// sync indexes the new connections and drops the closed ones, the lock must
+// be held.
+func (i *connectionIndex) sync() {
+	live := make(map[string]bool, len(i.keys))
+	statistic.DefaultManager.Range(func(c statistic.Tracker) bool {
+		id := c.ID()
+		live[id] = true
+		if _, ok := i.keys[id]; !ok {
+			metadata := c.Info().Metadata
+			key := connectionKey(metadata.SourceAddress(), metadata.RemoteAddress())
+			i.keys[id] = key
+			i.ids[key] = id
+		}
+		return true
+	})
+	for id, key := range i.keys {
+		if live[id] {
+			continue
+		}
+		delete(i.keys, id)
+		if i.ids[key] == id {
+			delete(i.ids, key)
+		}
+	}
+}
+
+// Resolve sets the connection id of the connection logs in records. mihomo
+// logs a connection right before tracking it, records are resolved off the
+// logger goroutine so the connection is tracked by then, the id is missing
+// once it is closed.
+func (i *connectionIndex) Resolve(records []*LogRecord) {
+	i.Lock()
+	defer i.Unlock()
+	synced := false
+	for _, record := range records {
+		if record.Component != RuleComponent || record.Fields["source"] == "" {
+			continue
+		}
+		key := connectionKey(record.Fields["source"], record.Fields["destination"])
+		id, ok := i.ids[key]
+		// a closed connection may have left its addresses to a new one
+		if ok && statistic.DefaultManager.Get(id) == nil {
+			ok = false
+		}
+		if !ok && !synced {
+			i.sync()
+			synced = true
+			id, ok = i.ids[key]
+		}
+		if ok {
+			record.ConnectionId = id
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"net/netip"
+	"testing"
+)
+
+type idTracker struct {
+	testTracker
+	id string
+}
+
+func (t *idTracker) ID() string {
+	return t.id
+}
+
+func trackTestConnection(t *testing.T, id string, source string, host string) statistic.Tracker {
+	t.Helper()
+	addrPort := netip.MustParseAddrPort(source)
+	tracker := &idTracker{testTracker{info: &statistic.TrackerInfo{Metadata: &constant.Metadata{
+		NetWork: constant.TCP,
+		SrcIP:   addrPort.Addr(),
+		SrcPort: addrPort.Port(),
+		Host:    host,
+		DstPort: 443,
+	}}}, id}
+	statistic.DefaultManager.Join(tracker)
+	t.Cleanup(func() {
+		statistic.DefaultManager.Leave(tracker)
+	})
+	return tracker
+}
+
+func TestParseLogPayload(t *testing.T) {
+	component, fields := parseLogPayload("[TCP] 10.0.0.1:1000(curl) --> example.com:443 match DOMAIN(example.com) using Proxy[node]")
+	if component != RuleComponent || fields["source"] != "10.0.0.1:1000" || fields["process"] != "curl" ||
+		fields["destination"] != "example.com:443" || fields["rule"] != "DOMAIN(example.com)" {
+		t.Fatalf("match line = %s %v", component, fields)
+	}
+	component, fields = parseLogPayload("[UDP] dial node (match MATCH/) 10.0.0.1:1000 --> example.com:443 error: timeout")
+	if component != DialerComponent || fields["proxy"] != "node" || fields["error"] != "timeout" {
+		t.Fatalf("dial line = %s %v", component, fields)
+	}
+	if component, fields = parseLogPayload("[Provider] pull failed name=subscription"); component != ProviderComponent || fields["name"] != "subscription" {
+		t.Fatalf("provider line = %s %v", component, fields)
+	}
+}
+
+func TestConnectionIndex(t *testing.T) {
+	current := connections
+	connections = &connectionIndex{ids: map[string]string{}, keys: map[string]string{}}
+	t.Cleanup(func() {
+		connections = current
+	})
+	store := &logStore{records: make([]*LogRecord, 0, logBufferSize), subscriptions: map[string]*logSubscription{}}
+	line := "[TCP] 10.0.0.1:1000(curl) --> example.com:443 match DOMAIN(example.com) using Proxy[node]"
+
+	first := trackTestConnection(t, "first", "10.0.0.1:1000", "example.com")
+	trackTestConnection(t, "other", "10.0.0.2:2000", "example.org")
+	store.Add(
+		log.Event{LogLevel: log.INFO, Payload: line},
+		log.Event{LogLevel: log.INFO, Payload: "[TCP] 10.0.0.9:9000 --> example.net:443 match MATCH using DIRECT"},
+		log.Event{LogLevel: log.INFO, Payload: "[Rule] not a connection"},
+	)
+	records := store.Records()
+	if records[0].ConnectionId != "first" || records[1].ConnectionId != "" || records[2].ConnectionId != "" {
+		t.Fatalf("connection ids %q %q %q", records[0].ConnectionId, records[1].ConnectionId, records[2].ConnectionId)
+	}
+	if connections.ids[connectionKey("10.0.0.2:2000", "example.org:443")] != "other" {
+		t.Fatalf("index = %v, want every tracked connection", connections.ids)
+	}
+
+	// a new connection from the same source port replaces the closed one
+	statistic.DefaultManager.Leave(first)
+	trackTestConnection(t, "second", "10.0.0.1:1000", "example.com")
+	store.Add(log.Event{LogLevel: log.INFO, Payload: line})
+	if id := store.Records()[3].ConnectionId; id != "second" {
+		t.Fatalf("connection id = %q after the port was reused", id)
+	}
+	if _, ok := connections.keys["first"]; ok {
+		t.Fatal("closed connection kept in the index")
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logDir               = "logs"
+	logFileName          = "core.log"
+	rotatedLogFilePrefix = "core-"
+	rotatedLogTimeLayout = "20060102-150405.000"
+	defaultLogMaxSize    = 5 * 1024 * 1024
+	defaultLogMaxBackups = 5
+	logFileParamsName    = "log-file.json"
+)
+
+type LogFileParams struct {
+	Enable     bool         `json:"enable"`
+	Level      log.LogLevel `json:"level"`
+	MaxSize    int64        `json:"max-size"`
+	MaxAge     int64        `json:"max-age"`
+	MaxBackups int          `json:"max-backups"`
+	Compress   bool         `json:"compress"`
+}
+
+// logFileWriter appends records to logs/core.log in the home dir and rotates
+// it by size, rotated files are pruned by age and count.
+type logFileWriter struct {
+	sync.Mutex
+	params *LogFileParams
+	file   *os.File
+	size   int64
+}
+
+var logFile = &logFileWriter{}
+
+func logDirPath() string {
+	return constant.Path.Resolve(logDir)
+}
+
+func (w *logFileWriter) open() error {
+	if err := os.MkdirAll(logDirPath(), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(logDirPath(), logFileName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+func (w *logFileWriter) close() {
+	if w.file != nil {
+		_ = w.file.Close()
+		w.file = nil
+	}
+}
+
+func logFileParamsPath() string {
+	return filepath.Join(logDirPath(), logFileParamsName)
+}
+
+// Load applies the params saved by the last Update.
+func (w *logFileWriter) Load() {
+	data, err := readFile(logFileParamsPath())
+	if err != nil {
+		return
+	}
+	params := &LogFileParams{}
+	if err = json.Unmarshal(data, params); err != nil {
+		log.Warnln("[Log] load log file params error: %v", err)
+		return
+	}
+	if err = w.update(params); err != nil {
+		log.Warnln("[Log] open log file error: %v", err)
+	}
+}
+
+// Update applies params and saves them for the next start.
+func (w *logFileWriter) Update(params *LogFileParams) error {
+	if err := w.update(params); err != nil {
+		return err
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(logDirPath(), 0o755); err != nil {
+		return err
+	}
+	return safeWriteFile(logFileParamsPath(), data)
+}
+
+func (w *logFileWriter) update(params *LogFileParams) error {
+	if params.MaxSize <= 0 {
+		params.MaxSize = defaultLogMaxSize
+	}
+	if params.MaxBackups <= 0 {
+		params.MaxBackups = defaultLogMaxBackups
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.close()
+	w.params = nil
+	if !params.Enable {
+		return nil
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	w.params = params
+	w.prune()
+	return nil
+}
+
+// Level returns the level of the log file, false when it is disabled.
+func (w *logFileWriter) Level() (log.LogLevel, bool) {
+	w.Lock()
+	defer w.Unlock()
+	if w.params == nil {
+		return log.SILENT, false
+	}
+	return w.params.Level, true
+}
+
+func (w *logFileWriter) Write(record *LogRecord) {
+	w.Lock()
+	defer w.Unlock()
+	if w.params == nil || w.file == nil || record.LogLevel < w.params.Level {
+		return
+	}
+	line := fmt.Sprintf("%s %s %s\n", record.Time.Format(time.RFC3339Nano), record.LogLevel.String(), record.Payload)
+	if w.size > 0 && w.size+int64(len(line)) > w.params.MaxSize {
+		if err := w.rotate(); err != nil {
+			return
+		}
+	}
+	n, err := w.file.WriteString(line)
+	w.size += int64(n)
+	if err != nil {
+		w.close()
+	}
+}
+
+func (w *logFileWriter) rotate() error {
+	w.close()
+	path := filepath.Join(logDirPath(), logFileName)
+	rotated := filepath.Join(logDirPath(), rotatedLogFilePrefix+time.Now().Format(rotatedLogTimeLayout)+".log")
+	if err := os.Rename(path, rotated); err != nil {
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	if !w.params.Compress {
+		w.prune()
+		return nil
+	}
+	// prune after the compression, so it never sees a file half compressed
+	go func() {
+		if err := compressLogFile(rotated); err != nil {
+			log.Warnln("[Log] compress %s error: %v", rotated, err)
+		}
+		w.Lock()
+		defer w.Unlock()
+		if w.params != nil {
+			w.prune()
+		}
+	}()
+	return nil
+}
+
+// prune removes rotated files older than MaxAge hours or beyond MaxBackups,
+// a rotation counts once when it exists both plain and compressed.
+func (w *logFileWriter) prune() {
+	files := rotatedLogFiles()
+	now := time.Now()
+	index := -1
+	last := ""
+	for _, file := range files {
+		if name := strings.TrimSuffix(file.Name(), ".gz"); name != last {
+			last = name
+			index++
+		}
+		expired := w.params.MaxAge > 0 && now.Sub(file.ModTime()) > time.Duration(w.params.MaxAge)*time.Hour
+		if expired || index >= w.params.MaxBackups {
+			_ = os.Remove(filepath.Join(logDirPath(), file.Name()))
+		}
+	}
+}
+
+// rotatedLogFiles returns the rotated log files from the newest to the oldest.
+func rotatedLogFiles() []os.FileInfo {
+	entries, err := os.ReadDir(logDirPath())
+	if err != nil {
+		return nil
+	}
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), rotatedLogFilePrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() > files[j].Name()
+	})
+	return files
+}
+
+func compressLogFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(dst)
+	_, err = io.Copy(writer, src)
+	err = errors.Join(err, writer.Close(), dst.Close())
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	_ = src.Close()
+	return os.Remove(path)
+}
+
+// readLogFile returns the content of a current or rotated log file,
+// decompressing it when needed.
+func readLogFile(path string) ([]byte, error) {
+	if !strings.HasSuffix(path, ".gz") {
+		return os.ReadFile(path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"github.com/metacubex/mihomo/common/utils"
+	"github.com/metacubex/mihomo/log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	logBufferSize          = 2000
+	logQueueSize           = 1024
+	defaultLogSubscription = ""
+	dnsLogPrefix           = "[DNS] "
+)
+
+// LogRecord is a mihomo log event, Component, ConnectionId and Fields are
+// parsed from the payload on a best-effort basis, see parseLogPayload.
+type LogRecord struct {
+	Id           uint64            `json:"id"`
+	LogLevel     log.LogLevel      `json:"LogLevel"`
+	Payload      string            `json:"Payload"`
+	Component    LogComponent      `json:"component,omitempty"`
+	ConnectionId string            `json:"connection-id,omitempty"`
+	Fields       map[string]string `json:"fields,omitempty"`
+	Time         time.Time         `json:"time"`
+	Subscription string            `json:"subscription,omitempty"`
+}
+
+type QueryLogsParams struct {
+	Level        *log.LogLevel `json:"level"`
+	Component    LogComponent  `json:"component"`
+	ConnectionId string        `json:"connection-id"`
+	Keyword      string        `json:"keyword"`
+	Since        *time.Time    `json:"since"`
+	Until        *time.Time    `json:"until"`
+	Limit        int           `json:"limit"`
+}
+
+type SubscribeLogParams struct {
+	Level log.LogLevel `json:"level"`
+}
+
+type logSubscription struct {
+	id    string
+	level *log.LogLevel
+}
+
+// logStore keeps the latest records in a ring buffer and fans every record out
+// to the subscriptions whose level it reaches.
+type logStore struct {
+	sync.Mutex
+	records       []*LogRecord
+	next          int
+	lastId        uint64
+	subscriptions map[string]*logSubscription
+	// level is the lowest level a subscription or the log file asks for
+	level atomic.Int32
+	start sync.Once
+}
+
+var logs = &logStore{
+	records:       make([]*LogRecord, 0, logBufferSize),
+	subscriptions: map[string]*logSubscription{},
+}
+
+// Start subscribes to the mihomo log once. The logger waits on every
+// subscriber, so events are only filtered and queued here and dropped when
+// the queue is full. Resolver events feed the dns query log through their
+// own queue and only reach the records when they reach the level.
+func (s *logStore) Start() {
+	s.start.Do(func() {
+		s.RefreshLevel()
+		queue := make(chan log.Event, logQueueSize)
+		dnsQueue := make(chan log.Event, logQueueSize)
+		subscriber := log.Subscribe()
+		go func() {
+			for event := range subscriber {
+				if strings.HasPrefix(event.Payload, dnsLogPrefix) {
+					select {
+					case dnsQueue <- event:
+					default:
+					}
+				}
+				if !s.wants(event) {
+					continue
+				}
+				select {
+				case queue <- event:
+				default:
+				}
+			}
+		}()
+		go func() {
+			for event := range queue {
+				s.Add(drainLogQueue(queue, event)...)
+			}
+		}()
+		go func() {
+			for event := range dnsQueue {
+				dnsQueries.Observe(event.Payload, time.Now())
+			}
+		}()
+	})
+}
+
+// drainLogQueue returns first with the events already queued after it.
+func drainLogQueue(queue chan log.Event, first log.Event) []log.Event {
+	events := []log.Event{first}
+	for len(events) < logQueueSize {
+		select {
+		case event := <-queue:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+	return events
+}
+
+// wants reports whether event reaches the active level.
+func (s *logStore) wants(event log.Event) bool {
+	level := log.Level()
+	if min := log.LogLevel(s.level.Load()); min < level {
+		level = min
+	}
+	return event.LogLevel >= level
+}
+
+// refreshLevel recomputes the lowest level asked for, the lock must be held.
+func (s *logStore) refreshLevel() {
+	level := log.SILENT
+	for _, subscription := range s.subscriptions {
+		if subscription.level != nil && *subscription.level < level {
+			level = *subscription.level
+		}
+	}
+	if fileLevel, ok := logFile.Level(); ok && fileLevel < level {
+		level = fileLevel
+	}
+	s.level.Store(int32(level))
+}
+
+// Add parses events and stores them as records, the connection ids of a
+// batch are resolved together.
+func (s *logStore) Add(events ...log.Event) {
+	now := time.Now()
+	records := make([]*LogRecord, 0, len(events))
+	for _, event := range events {
+		component, fields := parseLogPayload(event.Payload)
+		records = append(records, &LogRecord{
+			LogLevel:  event.LogLevel,
+			Payload:   event.Payload,
+			Component: component,
+			Fields:    fields,
+			Time:      now,
+		})
+	}
+	connections.Resolve(records)
+	for _, record := range records {
+		s.add(record)
+	}
+}
+
+func (s *logStore) add(record *LogRecord) {
+	s.Lock()
+	s.lastId++
+	record.Id = s.lastId
+	if len(s.records) < logBufferSize {
+		s.records = append(s.records, record)
+	} else {
+		s.records[s.next] = record
+		s.next = (s.next + 1) % logBufferSize
+	}
+	subscriptions := make([]*logSubscription, 0, len(s.subscriptions))
+	for _, subscription := range s.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	s.Unlock()
+	logFile.Write(record)
+	if record.LogLevel == log.ERROR {
+		tunStatus.Observe(record.Payload)
+	}
+	for _, subscription := range subscriptions {
+		level := log.Level()
+		if subscription.level != nil {
+			level = *subscription.level
+		}
+		if record.LogLevel < level {
+			continue
+		}
+		data := *record
+		data.Subscription = subscription.id
+		sendMessage(Message{
+			Type: LogMessage,
+			Data: &data,
+		})
+	}
+}
+
+// RefreshLevel picks up a changed log file level.
+func (s *logStore) RefreshLevel() {
+	s.Lock()
+	defer s.Unlock()
+	s.refreshLevel()
+}
+
+// Records returns the buffered records from the oldest to the newest.
+func (s *logStore) Records() []*LogRecord {
+	s.Lock()
+	defer s.Unlock()
+	records := make([]*LogRecord, 0, len(s.records))
+	records = append(records, s.records[s.next:]...)
+	records = append(records, s.records[:s.next]...)
+	return records
+}
+
+// Subscribe adds a subscription receiving records from level up, a nil level
+// follows the global log level.
+func (s *logStore) Subscribe(id string, level *log.LogLevel) {
+	s.Lock()
+	defer s.Unlock()
+	s.subscriptions[id] = &logSubscription{
+		id:    id,
+		level: level,
+	}
+	s.refreshLevel()
+}
+
+func (s *logStore) UnSubscribe(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.subscriptions[id]
+	delete(s.subscriptions, id)
+	s.refreshLevel()
+	return ok
+}
+
+func queryLogs(params *QueryLogsParams) []*LogRecord {
+	keyword := strings.ToLower(params.Keyword)
+	result := []*LogRecord{}
+	for _, record := range logs.Records() {
+		if params.Level != nil && record.LogLevel < *params.Level {
+			continue
+		}
+		if params.Component != "" && record.Component != params.Component {
+			continue
+		}
+		if params.ConnectionId != "" && record.ConnectionId != params.ConnectionId {
+			continue
+		}
+		if params.Since != nil && record.Time.Before(*params.Since) {
+			continue
+		}
+		if params.Until != nil && record.Time.After(*params.Until) {
+			continue
+		}
+		if keyword != "" && !strings.Contains(strings.ToLower(record.Payload), keyword) {
+			continue
+		}
+		result = append(result, record)
+	}
+	if params.Limit > 0 && len(result) > params.Limit {
+		result = result[len(result)-params.Limit:]
+	}
+	return result
+}
+
+func subscribeLog(params *SubscribeLogParams) string {
+	id := utils.NewUUIDV4().String()
+	level := params.Level
+	logs.Subscribe(id, &level)
+	return id
+}
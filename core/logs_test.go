@@ -0,0 +1,152 @@
+//go:build !cgo
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/metacubex/mihomo/log"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestLogStore(t *testing.T) *logStore {
+	t.Helper()
+	store := &logStore{
+		records:       make([]*LogRecord, 0, logBufferSize),
+		subscriptions: map[string]*logSubscription{},
+	}
+	current := logs
+	logs = store
+	t.Cleanup(func() {
+		logs = current
+	})
+	return store
+}
+
+// captureMessages collects the messages sent to the client until the test
+// ends.
+func captureMessages(t *testing.T) <-chan Message {
+	t.Helper()
+	client, server := net.Pipe()
+	conn = server
+	messages := make(chan Message, 16)
+	go func() {
+		reader := bufio.NewReader(client)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			var result struct {
+				Data Message `json:"data"`
+			}
+			if json.Unmarshal(line, &result) == nil {
+				messages <- result.Data
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		conn = nil
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return messages
+}
+
+func TestLogStoreRing(t *testing.T) {
+	store := newTestLogStore(t)
+	for i := 0; i < logBufferSize+10; i++ {
+		store.Add(log.Event{LogLevel: log.INFO, Payload: "[Rule] test"})
+	}
+	records := store.Records()
+	if len(records) != logBufferSize {
+		t.Fatalf("%d records kept, want %d", len(records), logBufferSize)
+	}
+	for i, record := range records {
+		if record.Id != uint64(i+11) {
+			t.Fatalf("record %d has id %d, the ring is out of order", i, record.Id)
+		}
+	}
+}
+
+func TestQueryLogs(t *testing.T) {
+	store := newTestLogStore(t)
+	store.Add(log.Event{LogLevel: log.DEBUG, Payload: "[Rule] debug line"})
+	store.Add(log.Event{LogLevel: log.WARNING, Payload: "[Provider] pull failed name=subscription"})
+	store.Add(log.Event{LogLevel: log.ERROR, Payload: "[TUN] Start TUN listening error: busy"})
+	store.Add(log.Event{LogLevel: log.INFO, Payload: "[Rule] info line"})
+
+	warning := log.WARNING
+	for _, test := range []struct {
+		params *QueryLogsParams
+		ids    []uint64
+	}{
+		{&QueryLogsParams{}, []uint64{1, 2, 3, 4}},
+		{&QueryLogsParams{Level: &warning}, []uint64{2, 3}},
+		{&QueryLogsParams{Component: ProviderComponent}, []uint64{2}},
+		{&QueryLogsParams{Keyword: "LINE"}, []uint64{1, 4}},
+		{&QueryLogsParams{Limit: 2}, []uint64{3, 4}},
+	} {
+		records := queryLogs(test.params)
+		ids := make([]uint64, 0, len(records))
+		for _, record := range records {
+			ids = append(ids, record.Id)
+		}
+		if len(ids) != len(test.ids) {
+			t.Errorf("%+v: got %v, want %v", test.params, ids, test.ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != test.ids[i] {
+				t.Errorf("%+v: got %v, want %v", test.params, ids, test.ids)
+				break
+			}
+		}
+	}
+	if records := queryLogs(&QueryLogsParams{Component: ProviderComponent}); records[0].Fields["name"] != "subscription" {
+		t.Fatalf("fields = %v", records[0].Fields)
+	}
+}
+
+func TestLogSubscriptions(t *testing.T) {
+	store := newTestLogStore(t)
+	messages := captureMessages(t)
+	warning, debug := log.WARNING, log.DEBUG
+	store.Subscribe("warning", &warning)
+	store.Subscribe("debug", &debug)
+	if level := log.LogLevel(store.level.Load()); level != log.DEBUG {
+		t.Fatalf("level = %s with a debug subscription", level)
+	}
+	if !store.wants(log.Event{LogLevel: log.DEBUG, Payload: "[Rule] debug"}) {
+		t.Fatal("debug events dropped while a subscription asks for them")
+	}
+
+	store.Add(log.Event{LogLevel: log.INFO, Payload: "[Rule] info"})
+	select {
+	case message := <-messages:
+		data, _ := json.Marshal(message.Data)
+		var record LogRecord
+		if err := json.Unmarshal(data, &record); err != nil || message.Type != LogMessage || record.Subscription != "debug" || record.Payload != "[Rule] info" {
+			t.Fatalf("message = %+v", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription did not receive the record")
+	}
+	select {
+	case message := <-messages:
+		t.Fatalf("unexpected message %+v, the warning subscription got an info record", message)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if !store.UnSubscribe("debug") || store.UnSubscribe("debug") {
+		t.Fatal("unsubscribe did not report the removed subscription")
+	}
+	if level := log.LogLevel(store.level.Load()); level != log.WARNING {
+		t.Fatalf("level = %s after the debug subscription left", level)
+	}
+	if store.wants(log.Event{LogLevel: log.DEBUG, Payload: "[Rule] debug"}) {
+		t.Fatal("debug events kept without a subscription asking for them")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"github.com/metacubex/mihomo/component/geodata/router"
+	"github.com/metacubex/mihomo/component/mmdb"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/constant"
+	"google.golang.org/protobuf/proto"
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const lookupTimeout = time.Second * 5
+
+type LookupAddress struct {
+	IP             netip.Addr `json:"ip"`
+	CountryCodes   []string   `json:"country-codes"`
+	ASN            string     `json:"asn"`
+	ASOrganization string     `json:"as-organization"`
+	FakeIP         bool       `json:"fake-ip"`
+	FakeIPHost     string     `json:"fake-ip-host,omitempty"`
+}
+
+type LookupResult struct {
+	Query     string           `json:"query"`
+	IsDomain  bool             `json:"is-domain"`
+	Addresses []*LookupAddress `json:"addresses"`
+	GeoSite   []string         `json:"geo-site"`
+	FakeIP    bool             `json:"fake-ip"`
+	Error     string           `json:"error,omitempty"`
+}
+
+func lookupAddress(ip netip.Addr) *LookupAddress {
+	address := &LookupAddress{
+		IP:           ip,
+		CountryCodes: []string{},
+	}
+	ip = ip.Unmap()
+	runLock.Lock()
+	if mmdbLoads(constant.Path.MMDB()) {
+		address.CountryCodes = mmdb.IPInstance().LookupCode(net.IP(ip.AsSlice()))
+	}
+	if mmdbLoads(constant.Path.ASN()) {
+		address.ASN, address.ASOrganization = mmdb.ASNInstance().LookupASN(net.IP(ip.AsSlice()))
+	}
+	runLock.Unlock()
+	if resolver.IsFakeIP(ip) {
+		address.FakeIP = true
+		address.FakeIPHost, _ = resolver.FindHostByIP(ip)
+	}
+	return address
+}
+
+// geoSiteCategory holds the domains of a GeoSite category prepared for
+// matching.
+type geoSiteCategory struct {
+	name    string
+	full    map[string]bool
+	domains map[string]bool
+	plain   []string
+	regexes []*regexp.Regexp
+}
+
+func newGeoSiteCategory(entry *router.GeoSite) *geoSiteCategory {
+	category := &geoSiteCategory{
+		name:    strings.ToLower(entry.CountryCode),
+		full:    map[string]bool{},
+		domains: map[string]bool{},
+	}
+	for _, domain := range entry.Domain {
+		value := strings.ToLower(domain.GetValue())
+		switch domain.GetType() {
+		case router.Domain_Plain:
+			category.plain = append(category.plain, value)
+		case router.Domain_Regex:
+			if regex, err := regexp.Compile(domain.GetValue()); err == nil {
+				category.regexes = append(category.regexes, regex)
+			}
+		case router.Domain_Domain:
+			category.domains[value] = true
+		case router.Domain_Full:
+			category.full[value] = true
+		}
+	}
+	return category
+}
+
+func (c *geoSiteCategory) match(host string) bool {
+	if c.full[host] {
+		return true
+	}
+	for suffix := host; suffix != ""; {
+		if c.domains[suffix] {
+			return true
+		}
+		_, rest, ok := strings.Cut(suffix, ".")
+		if !ok {
+			break
+		}
+		suffix = rest
+	}
+	for _, plain := range c.plain {
+		if strings.Contains(host, plain) {
+			return true
+		}
+	}
+	for _, regex := range c.regexes {
+		if regex.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	geoSiteLock       sync.Mutex
+	geoSiteVersion    geoFileVersion
+	geoSiteCategories []*geoSiteCategory
+)
+
+// loadGeoSiteCategories parses the GeoSite file once per file version.
+func loadGeoSiteCategories() []*geoSiteCategory {
+	path := constant.Path.GeoSite()
+	version, ok := statGeoFile(path)
+	if !ok {
+		return nil
+	}
+	geoSiteLock.Lock()
+	defer geoSiteLock.Unlock()
+	if geoSiteCategories != nil && geoSiteVersion == version {
+		return geoSiteCategories
+	}
+	data, err := readFile(path)
+	if err != nil {
+		return nil
+	}
+	var list router.GeoSiteList
+	if err = proto.Unmarshal(data, &list); err != nil {
+		return nil
+	}
+	categories := make([]*geoSiteCategory, 0, len(list.Entry))
+	for _, entry := range list.Entry {
+		categories = append(categories, newGeoSiteCategory(entry))
+	}
+	geoSiteVersion = version
+	geoSiteCategories = categories
+	return categories
+}
+
+// lookupGeoSite returns every GeoSite category that contains host.
+func lookupGeoSite(host string) []string {
+	categories := []string{}
+	for _, category := range loadGeoSiteCategories() {
+		if category.match(host) {
+			categories = append(categories, category.name)
+		}
+	}
+	return categories
+}
+
+func isFakeIPDomain(host string) bool {
+	runLock.Lock()
+	defer runLock.Unlock()
+	if !resolver.FakeIPEnabled() || currentConfig == nil {
+		return false
+	}
+	pool := currentConfig.DNS.FakeIPRange
+	return pool != nil && !pool.ShouldSkipped(host)
+}
+
+func lookup(query string) *LookupResult {
+	query = strings.TrimSpace(query)
+	result := &LookupResult{
+		Query:     query,
+		Addresses: []*LookupAddress{},
+		GeoSite:   []string{},
+	}
+	if ip, err := netip.ParseAddr(query); err == nil {
+		address := lookupAddress(ip)
+		result.FakeIP = address.FakeIP
+		result.Addresses = append(result.Addresses, address)
+		return result
+	}
+	host := strings.ToLower(strings.TrimSuffix(query, "."))
+	result.IsDomain = true
+	result.GeoSite = lookupGeoSite(host)
+	result.FakeIP = isFakeIPDomain(host)
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	ips, err := resolver.LookupIP(ctx, host)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	for _, ip := range ips {
+		result.Addresses = append(result.Addresses, lookupAddress(ip))
+	}
+	return result
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/metacubex/mihomo/component/geodata/router"
+	"github.com/metacubex/mihomo/constant"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestGeoSiteCategoryMatch(t *testing.T) {
+	category := newGeoSiteCategory(&router.GeoSite{
+		CountryCode: "TEST",
+		Domain: []*router.Domain{
+			{Type: router.Domain_Full, Value: "full.example"},
+			{Type: router.Domain_Domain, Value: "Example.org"},
+			{Type: router.Domain_Plain, Value: "keyword"},
+			{Type: router.Domain_Regex, Value: `^ad[0-9]+\.`},
+			{Type: router.Domain_Regex, Value: `(`},
+		},
+	})
+	if category.name != "test" || len(category.regexes) != 1 {
+		t.Fatalf("category = %+v", category)
+	}
+	for host, want := range map[string]bool{
+		"full.example":     true,
+		"sub.full.example": false,
+		"example.org":      true,
+		"a.b.example.org":  true,
+		"badexample.org":   false,
+		"my-keyword.net":   true,
+		"ad12.example.net": true,
+		"bad12.example":    false,
+	} {
+		if got := category.match(host); got != want {
+			t.Errorf("match(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestLookupGeoSite(t *testing.T) {
+	useTestHomeDir(t)
+	data, err := proto.Marshal(&router.GeoSiteList{Entry: []*router.GeoSite{
+		{CountryCode: "CN", Domain: []*router.Domain{{Type: router.Domain_Domain, Value: "example.cn"}}},
+		{CountryCode: "TEST", Domain: []*router.Domain{{Type: router.Domain_Plain, Value: "example"}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(constant.Path.GeoSite(), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := lookupGeoSite("www.example.cn"); !reflect.DeepEqual(got, []string{"cn", "test"}) {
+		t.Fatalf("lookupGeoSite = %v", got)
+	}
+	if got := lookupGeoSite("other.net"); len(got) != 0 {
+		t.Fatalf("lookupGeoSite = %v, want none", got)
+	}
+}
+
+func TestLookupIPWithoutDatabases(t *testing.T) {
+	useTestHomeDir(t)
+	result := lookup(" 192.0.2.1 ")
+	if result.IsDomain || result.Error != "" || len(result.Addresses) != 1 {
+		t.Fatalf("lookup = %+v", result)
+	}
+	address := result.Addresses[0]
+	if address.IP.String() != "192.0.2.1" || len(address.CountryCodes) != 0 || address.ASN != "" || address.FakeIP {
+		t.Fatalf("address = %+v", address)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/config"
+	"gopkg.in/yaml.v3"
+	"strings"
+)
+
+const (
+	prependOverridePrefix = "prepend-"
+	appendOverridePrefix  = "append-"
+	deleteOverrideKey     = "delete"
+)
+
+// ConfigOverride is a document merged over the base config. Maps are merged
+// deeply and other values replace the base, besides the special keys:
+//
+//	prepend-<key>, append-<key>  insert list items before or after the base list,
+//	                             items with the name of an existing one replace it
+//	delete                       list of dotted key paths removed from the base,
+//	                             removed keys fall back to their defaults
+type ConfigOverride map[string]any
+
+func toStringList(value any) ([]string, error) {
+	items, ok := value.([]any)
+	if !ok {
+		return nil, errors.New("must be a list")
+	}
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, errors.New("must be a list of string")
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+func itemName(item any) string {
+	if mapping, ok := item.(map[string]any); ok {
+		if name, ok := mapping["name"].(string); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// normalizeValue turns the json.Number values of decoded json into numbers
+// yaml can encode.
+func normalizeValue(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for key, item := range v {
+			v[key] = normalizeValue(item)
+		}
+	case []any:
+		for index, item := range v {
+			v[index] = normalizeValue(item)
+		}
+	}
+	return value
+}
+
+func mergeList(base []any, items []any, prepend bool) []any {
+	names := map[string]int{}
+	for index, item := range base {
+		if name := itemName(item); name != "" {
+			names[name] = index
+		}
+	}
+	added := make([]any, 0, len(items))
+	for _, item := range items {
+		if index, ok := names[itemName(item)]; ok {
+			base[index] = item
+			continue
+		}
+		added = append(added, item)
+	}
+	if prepend {
+		return append(added, base...)
+	}
+	return append(base, added...)
+}
+
+func mergeMap(base map[string]any, override map[string]any) {
+	for key, value := range override {
+		overrideMap, ok := value.(map[string]any)
+		if !ok {
+			base[key] = value
+			continue
+		}
+		baseMap, ok := base[key].(map[string]any)
+		if !ok {
+			base[key] = value
+			continue
+		}
+		mergeMap(baseMap, overrideMap)
+	}
+}
+
+func deletePath(base map[string]any, path string) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := base[key].(map[string]any)
+		if !ok {
+			return
+		}
+		base = next
+	}
+	delete(base, keys[len(keys)-1])
+}
+
+func applyOverride(base map[string]any, override ConfigOverride) error {
+	normalizeValue(map[string]any(override))
+	if value, ok := override[deleteOverrideKey]; ok {
+		paths, err := toStringList(value)
+		if err != nil {
+			return fmt.Errorf("%s %v", deleteOverrideKey, err)
+		}
+		for _, path := range paths {
+			deletePath(base, path)
+		}
+	}
+	merged := map[string]any{}
+	for key, value := range override {
+		if key == deleteOverrideKey {
+			continue
+		}
+		prepend := strings.HasPrefix(key, prependOverridePrefix)
+		if !prepend && !strings.HasPrefix(key, appendOverridePrefix) {
+			merged[key] = value
+			continue
+		}
+		target := strings.TrimPrefix(strings.TrimPrefix(key, prependOverridePrefix), appendOverridePrefix)
+		items, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("%s must be a list", key)
+		}
+		list, ok := base[target].([]any)
+		if !ok && base[target] != nil {
+			return fmt.Errorf("%s is not a list", target)
+		}
+		base[target] = mergeList(list, items, prepend)
+	}
+	mergeMap(base, merged)
+	return nil
+}
+
+// rawConfigToMap converts raw to the generic form keyed by its yaml names.
+func rawConfigToMap(raw *config.RawConfig) (map[string]any, error) {
+	data, err := yaml.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	mapping := map[string]any{}
+	if err = yaml.Unmarshal(data, &mapping); err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+func mapToRawConfig(mapping map[string]any) (*config.RawConfig, error) {
+	data, err := yaml.Marshal(mapping)
+	if err != nil {
+		return nil, err
+	}
+	return config.UnmarshalRawConfig(data)
+}
+
+// mergeConfig merges overrides in order over raw and parses the result again.
+func mergeConfig(raw *config.RawConfig, overrides []ConfigOverride) (*config.RawConfig, error) {
+	base, err := rawConfigToMap(raw)
+	if err != nil {
+		return nil, err
+	}
+	for index, override := range overrides {
+		if err = applyOverride(base, override); err != nil {
+			return nil, fmt.Errorf("override[%d] %v", index, err)
+		}
+	}
+	return mapToRawConfig(base)
+}
+
+// getMergedConfig returns the yaml of params.Config with params.Overrides
+// merged, without running the script or applying it. Without params it
+// returns the merged config of the last successful setup.
+func getMergedConfig(params *SetupParams) (string, error) {
+	var merged *config.RawConfig
+	if params == nil {
+		runLock.Lock()
+		if lastGoodSetupParams != nil {
+			merged = lastGoodSetupParams.merged
+		}
+		runLock.Unlock()
+		if merged == nil {
+			return "", errors.New("config not applied")
+		}
+	} else {
+		var err error
+		if merged, err = mergeConfig(params.Config, params.Overrides); err != nil {
+			return "", err
+		}
+	}
+	data, err := yaml.Marshal(merged)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
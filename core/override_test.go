@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decodeOverride(t *testing.T, data string) ConfigOverride {
+	t.Helper()
+	override := ConfigOverride{}
+	if err := UnmarshalJson([]byte(data), &override); err != nil {
+		t.Fatal(err)
+	}
+	return override
+}
+
+func TestApplyOverride(t *testing.T) {
+	base := map[string]any{}
+	if err := json.Unmarshal([]byte(`{
+		"mode": "rule",
+		"dns": {"enable": false, "ipv6": true, "nameserver": ["1.1.1.1"]},
+		"proxies": [{"name": "a", "port": 1}, {"name": "b", "port": 2}],
+		"rules": ["MATCH,a"]
+	}`), &base); err != nil {
+		t.Fatal(err)
+	}
+	err := applyOverride(base, decodeOverride(t, `{
+		"dns": {"enable": true},
+		"prepend-rules": ["DOMAIN,example.com,DIRECT"],
+		"append-proxies": [{"name": "b", "port": 3}, {"name": "c", "port": 4}],
+		"delete": ["dns.nameserver", "mode"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"dns": map[string]any{"enable": true, "ipv6": true},
+		"proxies": []any{
+			map[string]any{"name": "a", "port": float64(1)},
+			map[string]any{"name": "b", "port": int64(3)},
+			map[string]any{"name": "c", "port": int64(4)},
+		},
+		"rules": []any{"DOMAIN,example.com,DIRECT", "MATCH,a"},
+	}
+	if !reflect.DeepEqual(base, want) {
+		t.Fatalf("merged %#v,\nwant %#v", base, want)
+	}
+
+	for _, test := range []struct {
+		override string
+		err      string
+	}{
+		{`{"prepend-rules": "MATCH,DIRECT"}`, "prepend-rules must be a list"},
+		{`{"append-dns": ["1.1.1.1"]}`, "dns is not a list"},
+		{`{"delete": "mode"}`, "delete must be a list"},
+		{`{"delete": [1]}`, "delete must be a list of string"},
+	} {
+		if err := applyOverride(base, decodeOverride(t, test.override)); err == nil || err.Error() != test.err {
+			t.Errorf("%s: error %v, want %s", test.override, err, test.err)
+		}
+	}
+}
+
+func TestMergeConfig(t *testing.T) {
+	raw := testSetupParams("proxy", "MATCH,proxy").Config
+	merged, err := mergeConfig(raw, []ConfigOverride{
+		decodeOverride(t, `{"mixed-port": 7890, "append-rules": ["MATCH,DIRECT"]}`),
+		decodeOverride(t, `{"prepend-rules": ["DOMAIN,example.com,proxy"], "delete": ["mixed-port"]}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"DOMAIN,example.com,proxy", "MATCH,proxy", "MATCH,DIRECT"}; !reflect.DeepEqual(merged.Rule, want) {
+		t.Fatalf("merged rules %v, want %v", merged.Rule, want)
+	}
+	if merged.MixedPort != 0 || len(merged.Proxy) != 1 {
+		t.Fatalf("merged config %+v", merged)
+	}
+	if len(raw.Rule) != 1 {
+		t.Fatal("mergeConfig changed the base config")
+	}
+
+	_, err = mergeConfig(raw, []ConfigOverride{{}, decodeOverride(t, `{"append-rules": 1}`)})
+	if err == nil || !strings.HasPrefix(err.Error(), "override[1]") {
+		t.Fatalf("error %v, want the index of the failing override", err)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redactedValue = "******"
+
+type RedactionParams struct {
+	ShareSafe *bool    `json:"share-safe"`
+	Patterns  []string `json:"patterns"`
+	Keys      []string `json:"keys"`
+}
+
+type RedactionState struct {
+	ShareSafe bool     `json:"share-safe"`
+	Patterns  []string `json:"patterns"`
+	Keys      []string `json:"keys"`
+}
+
+type redactPattern struct {
+	regexp  *regexp.Regexp
+	replace string
+}
+
+var defaultSecretKeys = []string{
+	"password",
+	"uuid",
+	"private-key",
+	"pre-shared-key",
+	"psk",
+	"auth",
+	"auth-str",
+	"token",
+	"obfs-password",
+	"secret",
+	"short-id",
+	"ech-key",
+	"authentication",
+	"users",
+}
+
+var defaultRedactPatterns = []*redactPattern{
+	{
+		regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`),
+		redactedValue,
+	},
+	{
+		regexp.MustCompile(`(://)[^/@\s"\\]+@`),
+		"${1}" + redactedValue + "@",
+	},
+	{
+		regexp.MustCompile(`(?i)([?&](?:token|key|secret|password|passwd|auth|sign|uuid|sid|subscribe)=)[^&\s"\\]+`),
+		"${1}" + redactedValue,
+	},
+	{
+		regexp.MustCompile(`(?i)((?:password|passwd|private-key|pre-shared-key|psk|auth-str|token|secret|uuid)\\?"?\s*[:=]\s*\\?"?)[^"\s,}\\]+`),
+		"${1}" + redactedValue,
+	},
+}
+
+// redactor removes secrets from text leaving the core, shareSafe turns it on
+// for every outbound message.
+type redactor struct {
+	sync.RWMutex
+	shareSafe bool
+	patterns  []string
+	custom    []*redactPattern
+	keys      map[string]bool
+}
+
+var defaultRedactor = newRedactor()
+
+func newRedactor() *redactor {
+	r := &redactor{
+		keys: map[string]bool{},
+	}
+	for _, key := range defaultSecretKeys {
+		r.keys[key] = true
+	}
+	return r
+}
+
+func (r *redactor) Update(params *RedactionParams) error {
+	custom := make([]*redactPattern, 0, len(params.Patterns))
+	for _, pattern := range params.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("pattern %s: %v", pattern, err)
+		}
+		custom = append(custom, &redactPattern{
+			regexp:  re,
+			replace: redactedValue,
+		})
+	}
+	r.Lock()
+	defer r.Unlock()
+	if params.ShareSafe != nil {
+		r.shareSafe = *params.ShareSafe
+	}
+	if params.Patterns != nil {
+		r.patterns = params.Patterns
+		r.custom = custom
+	}
+	if params.Keys != nil {
+		r.keys = map[string]bool{}
+		for _, key := range defaultSecretKeys {
+			r.keys[key] = true
+		}
+		for _, key := range params.Keys {
+			r.keys[strings.ToLower(key)] = true
+		}
+	}
+	return nil
+}
+
+func (r *redactor) State() *RedactionState {
+	r.RLock()
+	defer r.RUnlock()
+	state := &RedactionState{
+		ShareSafe: r.shareSafe,
+		Patterns:  []string{},
+		Keys:      []string{},
+	}
+	state.Patterns = append(state.Patterns, r.patterns...)
+	for key := range r.keys {
+		state.Keys = append(state.Keys, key)
+	}
+	return state
+}
+
+func (r *redactor) ShareSafe() bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.shareSafe
+}
+
+// Redact replaces secrets found by the default and custom patterns in text.
+func (r *redactor) Redact(text string) string {
+	r.RLock()
+	defer r.RUnlock()
+	for _, pattern := range defaultRedactPatterns {
+		text = pattern.regexp.ReplaceAllString(text, pattern.replace)
+	}
+	for _, pattern := range r.custom {
+		text = pattern.regexp.ReplaceAllString(text, pattern.replace)
+	}
+	return text
+}
+
+// RedactConfig replaces the values of secret keys and the credentials of
+// urls in a config mapping in place.
+func (r *redactor) RedactConfig(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			r.RLock()
+			secret := r.keys[key]
+			r.RUnlock()
+			if secret {
+				v[key] = redactValue(item)
+				continue
+			}
+			v[key] = r.RedactConfig(item)
+		}
+	case []any:
+		for index, item := range v {
+			v[index] = r.RedactConfig(item)
+		}
+	case string:
+		if strings.Contains(v, "://") {
+			return redactURL(v)
+		}
+	}
+	return value
+}
+
+// Message returns message with its data redacted when share-safe is on.
+func (r *redactor) Message(message Message) Message {
+	message.Data = r.Data(message.Data)
+	return message
+}
+
+// Data returns data redacted when share-safe is on, as json.
+func (r *redactor) Data(data any) any {
+	if !r.ShareSafe() {
+		return data
+	}
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(data); err != nil {
+		return redactedValue
+	}
+	redacted := r.Redact(strings.TrimSuffix(buffer.String(), "\n"))
+	if json.Valid([]byte(redacted)) {
+		return json.RawMessage(redacted)
+	}
+	// a pattern broke the json, redact the strings in it one by one instead
+	var value any
+	if err := json.Unmarshal(buffer.Bytes(), &value); err != nil {
+		return redactedValue
+	}
+	return r.redactStrings(value)
+}
+
+func (r *redactor) redactStrings(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			v[key] = r.redactStrings(item)
+		}
+	case []any:
+		for index, item := range v {
+			v[index] = r.redactStrings(item)
+		}
+	case string:
+		return r.Redact(v)
+	}
+	return value
+}
+
+// redactValue replaces every scalar in value and keeps its shape, so the
+// redacted config still parses.
+func redactValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			v[key] = redactValue(item)
+		}
+		return v
+	case []any:
+		for index, item := range v {
+			v[index] = redactValue(item)
+		}
+		return v
+	}
+	return redactedValue
+}
+
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return value
+	}
+	if u.User != nil {
+		u.User = url.User(redactedValue)
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = redactedValue
+	}
+	return u.String()
+}
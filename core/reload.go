@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"github.com/metacubex/mihomo/common/batch"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/component/sniffer"
+	"github.com/metacubex/mihomo/config"
+	cp "github.com/metacubex/mihomo/constant/provider"
+	"github.com/metacubex/mihomo/dns"
+	"github.com/metacubex/mihomo/hub"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"reflect"
+)
+
+const providerLoadConcurrency = 5
+
+const (
+	AllSection       = "all"
+	ProxiesSection   = "proxies"
+	GroupsSection    = "groups"
+	RulesSection     = "rules"
+	DNSSection       = "dns"
+	ListenersSection = "listeners"
+	SnifferSection   = "sniffer"
+)
+
+// currentRawConfig is the raw config currentConfig was parsed from, it is the
+// base every new config is diffed against.
+var currentRawConfig *config.RawConfig
+
+type configDiff struct {
+	proxies       bool
+	groups        bool
+	proxyProvider bool
+	rules         bool
+	ruleProvider  bool
+	dns           bool
+	listeners     bool
+	sniffer       bool
+}
+
+func (d *configDiff) sections() []string {
+	sections := []string{}
+	if d.proxies || d.proxyProvider {
+		sections = append(sections, ProxiesSection)
+	}
+	if d.groups {
+		sections = append(sections, GroupsSection)
+	}
+	if d.rules || d.ruleProvider {
+		sections = append(sections, RulesSection)
+	}
+	if d.dns {
+		sections = append(sections, DNSSection)
+	}
+	if d.listeners {
+		sections = append(sections, ListenersSection)
+	}
+	if d.sniffer {
+		sections = append(sections, SnifferSection)
+	}
+	return sections
+}
+
+// withoutSections returns a shallow copy of raw with every section that can be
+// reloaded on its own cleared, what is left needs a full reload when changed.
+func withoutSections(raw *config.RawConfig) config.RawConfig {
+	rest := *raw
+	rest.Proxy = nil
+	rest.ProxyGroup = nil
+	rest.ProxyProvider = nil
+	rest.Rule = nil
+	rest.SubRules = nil
+	rest.RuleProvider = nil
+	rest.DNS = config.RawDNS{}
+	rest.Hosts = nil
+	rest.Sniffer = config.RawSniffer{}
+	rest.Port = 0
+	rest.SocksPort = 0
+	rest.RedirPort = 0
+	rest.TProxyPort = 0
+	rest.MixedPort = 0
+	rest.ShadowSocksConfig = ""
+	rest.VmessConfig = ""
+	rest.TuicServer = config.RawTuicServer{}
+	rest.AllowLan = false
+	rest.BindAddress = ""
+	rest.SkipAuthPrefixes = nil
+	rest.LanAllowedIPs = nil
+	rest.LanDisAllowedIPs = nil
+	rest.Listeners = nil
+	rest.Tun = config.RawTun{}
+	return rest
+}
+
+// diffConfig returns nil when old and new differ outside the sections that
+// can be reloaded on their own.
+func diffConfig(old *config.RawConfig, new *config.RawConfig) *configDiff {
+	if !reflect.DeepEqual(withoutSections(old), withoutSections(new)) {
+		return nil
+	}
+	return &configDiff{
+		proxies:       !reflect.DeepEqual(old.Proxy, new.Proxy),
+		groups:        !reflect.DeepEqual(old.ProxyGroup, new.ProxyGroup),
+		proxyProvider: !reflect.DeepEqual(old.ProxyProvider, new.ProxyProvider),
+		rules:         !reflect.DeepEqual(old.Rule, new.Rule) || !reflect.DeepEqual(old.SubRules, new.SubRules),
+		ruleProvider:  !reflect.DeepEqual(old.RuleProvider, new.RuleProvider),
+		dns:           !reflect.DeepEqual(old.DNS, new.DNS) || !reflect.DeepEqual(old.Hosts, new.Hosts),
+		listeners: old.Port != new.Port ||
+			old.SocksPort != new.SocksPort ||
+			old.RedirPort != new.RedirPort ||
+			old.TProxyPort != new.TProxyPort ||
+			old.MixedPort != new.MixedPort ||
+			old.ShadowSocksConfig != new.ShadowSocksConfig ||
+			old.VmessConfig != new.VmessConfig ||
+			old.AllowLan != new.AllowLan ||
+			old.BindAddress != new.BindAddress ||
+			!reflect.DeepEqual(old.TuicServer, new.TuicServer) ||
+			!reflect.DeepEqual(old.SkipAuthPrefixes, new.SkipAuthPrefixes) ||
+			!reflect.DeepEqual(old.LanAllowedIPs, new.LanAllowedIPs) ||
+			!reflect.DeepEqual(old.LanDisAllowedIPs, new.LanDisAllowedIPs) ||
+			!reflect.DeepEqual(old.Listeners, new.Listeners) ||
+			!reflect.DeepEqual(old.Tun, new.Tun),
+		sniffer: !reflect.DeepEqual(old.Sniffer, new.Sniffer),
+	}
+}
+
+// loadProviders initializes providers the way the executor does, at most
+// providerLoadConcurrency at once.
+func loadProviders[P cp.Provider](providers map[string]P) {
+	b, _ := batch.New[bool](context.Background(), batch.WithConcurrencyNum[bool](providerLoadConcurrency))
+	for _, p := range providers {
+		p := p
+		b.Go(p.Name(), func() (bool, error) {
+			if p.VehicleType() == cp.Compatible {
+				log.Infoln("Start initial compatible provider %s", p.Name())
+			} else {
+				log.Infoln("Start initial provider %s", p.Name())
+			}
+			if err := p.Initial(); err != nil {
+				switch p.Type() {
+				case cp.Proxy:
+					log.Errorln("initial proxy provider %s error: %v", p.Name(), err)
+				case cp.Rule:
+					log.Errorln("initial rule provider %s error: %v", p.Name(), err)
+				}
+				return false, err
+			}
+			return true, nil
+		})
+	}
+	b.Wait()
+}
+
+func reloadDNS(c *config.DNS, ipv6 bool) {
+	if !c.Enable {
+		resolver.DefaultResolver = nil
+		resolver.DefaultHostMapper = nil
+		resolver.DefaultLocalServer = nil
+		resolver.ProxyServerHostResolver = nil
+		resolver.DirectHostResolver = nil
+		dns.ReCreateServer("", nil, nil)
+		return
+	}
+	cfg := dns.Config{
+		Main:                 c.NameServer,
+		Fallback:             c.Fallback,
+		IPv6:                 c.IPv6 && ipv6,
+		IPv6Timeout:          c.IPv6Timeout,
+		EnhancedMode:         c.EnhancedMode,
+		Pool:                 c.FakeIPRange,
+		Hosts:                c.Hosts,
+		FallbackIPFilter:     c.FallbackIPFilter,
+		FallbackDomainFilter: c.FallbackDomainFilter,
+		Default:              c.DefaultNameserver,
+		Policy:               c.NameServerPolicy,
+		ProxyServer:          c.ProxyServerNameserver,
+		DirectServer:         c.DirectNameServer,
+		DirectFollowPolicy:   c.DirectFollowPolicy,
+		CacheAlgorithm:       c.CacheAlgorithm,
+	}
+	r := dns.NewResolver(cfg)
+	m := dns.NewEnhancer(cfg)
+	if old, ok := resolver.DefaultHostMapper.(*dns.ResolverEnhancer); ok {
+		m.PatchFrom(old)
+	}
+	resolver.DefaultResolver = r
+	resolver.DefaultHostMapper = m
+	resolver.DefaultLocalServer = dns.NewLocalServer(r.Resolver, m)
+	resolver.UseSystemHosts = c.UseSystemHosts
+	if r.ProxyResolver.Invalid() {
+		resolver.ProxyServerHostResolver = r.ProxyResolver
+	} else {
+		resolver.ProxyServerHostResolver = r.Resolver
+	}
+	if r.DirectResolver.Invalid() {
+		resolver.DirectHostResolver = r.DirectResolver
+	} else {
+		resolver.DirectHostResolver = r.Resolver
+	}
+	dns.ReCreateServer(c.Listen, r.Resolver, m)
+	hookDnsResolvers()
+}
+
+func reloadSniffer(c *sniffer.Config) {
+	dispatcher, err := sniffer.NewDispatcher(c)
+	if err != nil {
+		log.Warnln("[Config] reload sniffer error: %v", err)
+	}
+	tunnel.UpdateSniffer(dispatcher)
+}
+
+// reloadConfig applies cfg parsed from raw on top of the running config and
+// only touches the sections that changed, unchanged sections keep their
+// providers, caches and connections. It returns the reloaded sections.
+func reloadConfig(cfg *config.Config, raw *config.RawConfig) []string {
+	old := currentConfig
+	var diff *configDiff
+	if old != nil && currentRawConfig != nil {
+		diff = diffConfig(currentRawConfig, raw)
+	}
+	currentConfig = cfg
+	currentRawConfig = raw
+	if diff == nil {
+		hub.ApplyConfig(cfg)
+		hookDnsResolvers()
+		return []string{AllSection}
+	}
+	if diff.proxies || diff.groups || diff.proxyProvider {
+		tunnel.UpdateProxies(cfg.Proxies, cfg.Providers)
+		loadProviders(cfg.Providers)
+	} else {
+		cfg.Proxies = old.Proxies
+		cfg.Providers = old.Providers
+	}
+	if diff.ruleProvider {
+		loadProviders(cfg.RuleProviders)
+	} else {
+		cfg.RuleProviders = old.RuleProviders
+	}
+	if !diff.rules && !diff.ruleProvider {
+		cfg.Rules = old.Rules
+		cfg.SubRules = old.SubRules
+	}
+	if diff.dns {
+		resolver.DefaultHosts = resolver.NewHosts(cfg.Hosts)
+		reloadDNS(cfg.DNS, cfg.General.IPv6)
+	} else {
+		cfg.DNS = old.DNS
+		cfg.Hosts = old.Hosts
+	}
+	if diff.sniffer {
+		reloadSniffer(cfg.Sniffer)
+	}
+	sections := diff.sections()
+	log.Infoln("[Config] reload sections: %v", sections)
+	return sections
+}
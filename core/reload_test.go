@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/tunnel"
+	"reflect"
+	"testing"
+)
+
+func TestDiffConfig(t *testing.T) {
+	base := func() *config.RawConfig {
+		return testSetupParams("proxy", "MATCH,proxy").Config
+	}
+	for _, test := range []struct {
+		name     string
+		change   func(raw *config.RawConfig)
+		sections []string
+	}{
+		{"unchanged", func(raw *config.RawConfig) {}, []string{}},
+		{"proxies", func(raw *config.RawConfig) { raw.Proxy[0]["port"] = 1081 }, []string{ProxiesSection}},
+		{"rules", func(raw *config.RawConfig) { raw.Rule = []string{"MATCH,DIRECT"} }, []string{RulesSection}},
+		{"dns", func(raw *config.RawConfig) { raw.Hosts = map[string]any{"a.test": "192.0.2.1"} }, []string{DNSSection}},
+		{"listeners", func(raw *config.RawConfig) { raw.MixedPort = 7890 }, []string{ListenersSection}},
+		{"tun", func(raw *config.RawConfig) { raw.Tun.MTU = 1400 }, []string{ListenersSection}},
+	} {
+		old, raw := base(), base()
+		raw.Proxy = []map[string]any{{}}
+		for key, value := range old.Proxy[0] {
+			raw.Proxy[0][key] = value
+		}
+		test.change(raw)
+		diff := diffConfig(old, raw)
+		if diff == nil {
+			t.Errorf("%s: needs a full reload", test.name)
+			continue
+		}
+		if sections := diff.sections(); !reflect.DeepEqual(sections, test.sections) {
+			t.Errorf("%s: sections %v, want %v", test.name, sections, test.sections)
+		}
+	}
+	raw := base()
+	raw.Mode = tunnel.Global
+	if diff := diffConfig(base(), raw); diff != nil {
+		t.Errorf("a mode change reloads only %v", diff.sections())
+	}
+}
+
+func TestReloadConfigKeepsUnchangedSections(t *testing.T) {
+	resetSetupTest(t)
+	if result := setupConfig(testSetupParams("proxy", "MATCH,proxy")); !result.Applied || !reflect.DeepEqual(result.Reloaded, []string{AllSection}) {
+		t.Fatalf("first setup = %+v", result)
+	}
+	proxy := tunnel.Proxies()["proxy"]
+
+	// every setup gets its own params, the applied ones are kept as the base
+	newParams := func(proxies ...string) *SetupParams {
+		params := testSetupParams("proxy", "MATCH,proxy")
+		params.Config.Rule = []string{"DOMAIN,example.com,DIRECT", "MATCH,proxy"}
+		for i, name := range proxies {
+			params.Config.Proxy = append(params.Config.Proxy, map[string]any{"name": name, "type": "socks5", "server": "127.0.0.1", "port": 1081 + i})
+		}
+		return params
+	}
+	result := setupConfig(newParams())
+	if !result.Applied || !reflect.DeepEqual(result.Reloaded, []string{RulesSection}) || result.Rules != 2 {
+		t.Fatalf("rules setup = %+v", result)
+	}
+	if tunnel.Proxies()["proxy"] != proxy {
+		t.Fatal("a rules change recreated the proxies")
+	}
+
+	rules := currentConfig.Rules
+	result = setupConfig(newParams("other"))
+	if !result.Applied || !reflect.DeepEqual(result.Reloaded, []string{ProxiesSection}) {
+		t.Fatalf("proxies setup = %+v", result)
+	}
+	if &currentConfig.Rules[0] != &rules[0] {
+		t.Fatal("a proxies change rebuilt the rules")
+	}
+	if _, ok := tunnel.Proxies()["other"]; !ok {
+		t.Fatal("the added proxy is not running")
+	}
+
+	params := newParams("other")
+	params.Config.Mode = tunnel.Global
+	if result = setupConfig(params); !result.Applied || !reflect.DeepEqual(result.Reloaded, []string{AllSection}) {
+		t.Fatalf("mode setup = %+v", result)
+	}
+}
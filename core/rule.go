@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/tunnel"
+	"net/netip"
+	"path/filepath"
+	"strings"
+)
+
+type ExplainRuleParams struct {
+	Host         string  `json:"host"`
+	DstIP        string  `json:"dst-ip"`
+	DstPort      uint16  `json:"dst-port"`
+	SrcIP        string  `json:"src-ip"`
+	SrcPort      uint16  `json:"src-port"`
+	Network      string  `json:"network"`
+	Process      string  `json:"process"`
+	ProcessPath  string  `json:"process-path"`
+	Uid          *uint32 `json:"uid"`
+	Inbound      string  `json:"inbound"`
+	InboundType  string  `json:"inbound-type"`
+	SpecialRules string  `json:"special-rules"`
+}
+
+type ExplainDNS struct {
+	Host   string     `json:"host"`
+	IP     netip.Addr `json:"ip"`
+	Source string     `json:"source"`
+	Error  string     `json:"error,omitempty"`
+}
+
+type ExplainSkipped struct {
+	Index         int    `json:"index"`
+	AccessControl bool   `json:"access-control,omitempty"`
+	Rule          string `json:"rule"`
+	Payload       string `json:"payload"`
+	Proxy         string `json:"proxy"`
+	Reason        string `json:"reason"`
+}
+
+type ExplainResult struct {
+	Metadata      *constant.Metadata `json:"metadata"`
+	Mode          string             `json:"mode"`
+	Rule          string             `json:"rule"`
+	Payload       string             `json:"payload"`
+	Index         int                `json:"index"`
+	AccessControl bool               `json:"access-control,omitempty"`
+	Proxy         string             `json:"proxy"`
+	Chain         []string           `json:"chain"`
+	DNS           []*ExplainDNS      `json:"dns"`
+	Skipped       []*ExplainSkipped  `json:"skipped"`
+}
+
+func (params *ExplainRuleParams) toMetadata() (*constant.Metadata, error) {
+	metadata := &constant.Metadata{
+		NetWork:      constant.TCP,
+		Type:         constant.INNER,
+		Host:         strings.TrimSuffix(params.Host, "."),
+		DstPort:      params.DstPort,
+		SrcPort:      params.SrcPort,
+		Process:      params.Process,
+		ProcessPath:  params.ProcessPath,
+		InName:       params.Inbound,
+		SpecialRules: params.SpecialRules,
+	}
+	switch strings.ToLower(params.Network) {
+	case "", "tcp":
+	case "udp":
+		metadata.NetWork = constant.UDP
+	default:
+		return nil, errors.New("invalid network")
+	}
+	if params.InboundType != "" {
+		t, err := constant.ParseType(strings.ToUpper(params.InboundType))
+		if err != nil {
+			return nil, err
+		}
+		metadata.Type = *t
+	}
+	if params.DstIP != "" {
+		ip, err := netip.ParseAddr(params.DstIP)
+		if err != nil {
+			return nil, err
+		}
+		metadata.DstIP = ip.Unmap()
+	}
+	if params.SrcIP != "" {
+		ip, err := netip.ParseAddr(params.SrcIP)
+		if err != nil {
+			return nil, err
+		}
+		metadata.SrcIP = ip.Unmap()
+	}
+	if ip, err := netip.ParseAddr(metadata.Host); err == nil {
+		metadata.DstIP = ip.Unmap()
+		metadata.Host = ""
+	}
+	if metadata.Process != "" && metadata.ProcessPath == "" {
+		metadata.ProcessPath = metadata.Process
+	} else if metadata.Process == "" && metadata.ProcessPath != "" {
+		metadata.Process = filepath.Base(metadata.ProcessPath)
+	}
+	if params.Uid != nil {
+		metadata.Uid = *params.Uid
+	}
+	if metadata.Host == "" && !metadata.DstIP.IsValid() {
+		return nil, errors.New("host or dst-ip is required")
+	}
+	return metadata, nil
+}
+
+func proxyChain(proxy constant.Proxy, metadata *constant.Metadata) []string {
+	chain := make([]string, 0)
+	for p := proxy; p != nil; p = p.Unwrap(metadata, false) {
+		chain = append(chain, p.Name())
+	}
+	return chain
+}
+
+// explainRule mirrors the rule matching of the tunnel for synthetic metadata,
+// it never dials and never looks up the process of the request. The rules are
+// read under runLock and matched after releasing it, so slow DNS lookups never
+// block config updates.
+func explainRule(params *ExplainRuleParams) (*ExplainResult, error) {
+	metadata, err := params.toMetadata()
+	if err != nil {
+		return nil, err
+	}
+	result := &ExplainResult{
+		Metadata: metadata,
+		Mode:     tunnel.Mode().String(),
+		Index:    -1,
+		Chain:    []string{},
+		DNS:      []*ExplainDNS{},
+		Skipped:  []*ExplainSkipped{},
+	}
+	proxies := tunnel.Proxies()
+	finish := func(proxy constant.Proxy) (*ExplainResult, error) {
+		if proxy == nil {
+			return nil, errors.New("proxy not found")
+		}
+		result.Proxy = proxy.Name()
+		result.Chain = proxyChain(proxy, metadata)
+		return result, nil
+	}
+
+	if metadata.Host == "" && resolver.MappingEnabled() {
+		if host, exist := resolver.FindHostByIP(metadata.DstIP); exist {
+			result.DNS = append(result.DNS, &ExplainDNS{
+				Host:   host,
+				IP:     metadata.DstIP,
+				Source: "mapping",
+			})
+			metadata.Host = host
+			metadata.DNSMode = constant.DNSMapping
+			if resolver.FakeIPEnabled() {
+				metadata.DstIP = netip.Addr{}
+				metadata.DNSMode = constant.DNSFakeIP
+			}
+		} else if resolver.IsFakeIP(metadata.DstIP) {
+			return nil, errors.New("fake DNS record missing")
+		}
+	}
+
+	switch tunnel.Mode() {
+	case tunnel.Direct:
+		return finish(proxies["DIRECT"])
+	case tunnel.Global:
+		return finish(proxies["GLOBAL"])
+	}
+
+	resolved := false
+	if node, ok := resolver.DefaultHosts.Search(metadata.Host, false); ok {
+		metadata.DstIP, _ = node.RandIP()
+		resolved = true
+		result.DNS = append(result.DNS, &ExplainDNS{
+			Host:   metadata.Host,
+			IP:     metadata.DstIP,
+			Source: "hosts",
+		})
+	}
+
+	// the access control rules ahead of the profile have no index
+	runLock.Lock()
+	rules := tunnel.Rules()
+	offset := appRuleCount
+	if metadata.SpecialRules != "" && currentConfig != nil {
+		if subRules, ok := currentConfig.SubRules[metadata.SpecialRules]; ok {
+			rules = subRules
+			offset = 0
+		}
+	}
+	runLock.Unlock()
+	for index, rule := range rules {
+		if !resolved && rule.ShouldResolveIP() && metadata.Host != "" && !metadata.DstIP.IsValid() {
+			resolved = true
+			explainDNS := &ExplainDNS{
+				Host:   metadata.Host,
+				Source: "dns",
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), resolver.DefaultDNSTimeout)
+			ip, err := resolver.ResolveIP(ctx, metadata.Host)
+			cancel()
+			if err != nil {
+				explainDNS.Error = err.Error()
+			} else {
+				explainDNS.IP = ip
+				metadata.DstIP = ip
+			}
+			result.DNS = append(result.DNS, explainDNS)
+		}
+		matched, adapterName := rule.Match(metadata)
+		if !matched {
+			continue
+		}
+		ruleIndex, accessControl := index-offset, index < offset
+		if accessControl {
+			ruleIndex = -1
+		}
+		skip := func(reason string) {
+			result.Skipped = append(result.Skipped, &ExplainSkipped{
+				Index:         ruleIndex,
+				AccessControl: accessControl,
+				Rule:          rule.RuleType().String(),
+				Payload:       rule.Payload(),
+				Proxy:         adapterName,
+				Reason:        reason,
+			})
+		}
+		proxy, ok := proxies[adapterName]
+		if !ok {
+			skip("proxy not found")
+			continue
+		}
+		passed := false
+		for p := proxy; p != nil; p = p.Unwrap(metadata, false) {
+			if p.Type() == constant.Pass {
+				passed = true
+				break
+			}
+		}
+		if passed {
+			skip("pass")
+			continue
+		}
+		if metadata.NetWork == constant.UDP && !proxy.SupportUDP() {
+			skip("udp not supported")
+			continue
+		}
+		result.Rule = rule.RuleType().String()
+		result.Payload = rule.Payload()
+		result.Index = ruleIndex
+		result.AccessControl = accessControl
+		return finish(proxy)
+	}
+	return finish(proxies["DIRECT"])
+}
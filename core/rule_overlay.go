@@ -0,0 +1,469 @@
+package main
+
+import (
+	"core/state"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/common/utils"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	R "github.com/metacubex/mihomo/rules"
+	"github.com/metacubex/mihomo/tunnel"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	insertRuleOp = "insert"
+	removeRuleOp = "remove"
+	moveRuleOp   = "move"
+)
+
+// RuleOverlayItem is one edit of the rules. Remove and move items refer to
+// their rule by Target, the overlay id of the rule, and keep the key of the
+// rule in Rule so edits of profile rules are dropped once the profile changed.
+type RuleOverlayItem struct {
+	Id       string     `json:"id"`
+	Op       string     `json:"op"`
+	Rule     string     `json:"rule"`
+	Target   string     `json:"target,omitempty"`
+	Index    int        `json:"index"`
+	ExpireAt *time.Time `json:"expire-at,omitempty"`
+}
+
+type RuleOverlay struct {
+	Profile string             `json:"profile"`
+	Items   []*RuleOverlayItem `json:"items"`
+}
+
+type InsertRuleParams struct {
+	Rule  string `json:"rule"`
+	Index int    `json:"index"`
+	TTL   int64  `json:"ttl"`
+}
+
+type RemoveRuleParams struct {
+	Index int `json:"index"`
+}
+
+type MoveRuleParams struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+var (
+	ruleOverlay      = &RuleOverlay{Items: []*RuleOverlayItem{}}
+	ruleOverlayTimer *time.Timer
+	// appRuleCount is the number of access control rules ahead of the rules
+	// of the profile, the rule indexes leave them out.
+	appRuleCount int
+	// ruleOverlayIds holds the overlay ids of the running profile rules.
+	ruleOverlayIds []string
+)
+
+func ruleOverlayPath(profile string) string {
+	return constant.Path.GetPathByHash("overlays", profile)
+}
+
+func loadRuleOverlay(profile string) *RuleOverlay {
+	overlay := &RuleOverlay{
+		Profile: profile,
+		Items:   []*RuleOverlayItem{},
+	}
+	data, err := readFile(ruleOverlayPath(profile))
+	if err != nil {
+		return overlay
+	}
+	if err = json.Unmarshal(data, overlay); err != nil {
+		log.Warnln("[Rule] load overlay of %s error: %v", profile, err)
+	}
+	overlay.Profile = profile
+	return overlay
+}
+
+func saveRuleOverlay() error {
+	data, err := json.Marshal(ruleOverlay)
+	if err != nil {
+		return err
+	}
+	return safeWriteFile(ruleOverlayPath(ruleOverlay.Profile), data)
+}
+
+func splitRuleLine(line string) (ruleName string, payload string, target string, params []string, err error) {
+	rule := strings.Split(line, ",")
+	for i := range rule {
+		rule[i] = strings.TrimSpace(rule[i])
+	}
+	ruleName = strings.ToUpper(rule[0])
+	l := len(rule)
+	if l < 2 {
+		return "", "", "", nil, errors.New("format invalid")
+	}
+	switch ruleName {
+	case "NOT", "OR", "AND", "SUB-RULE", "DOMAIN-REGEX", "PROCESS-NAME-REGEX", "PROCESS-PATH-REGEX":
+		target = rule[l-1]
+		payload = strings.Join(rule[1:l-1], ",")
+	default:
+		if l < 4 {
+			rule = append(rule, make([]string, 4-l)...)
+		}
+		if ruleName == "MATCH" {
+			l = 2
+		}
+		if l >= 3 {
+			l = 3
+			payload = rule[1]
+		}
+		target = rule[l-1]
+		for _, param := range rule[l:] {
+			if param != "" {
+				params = append(params, param)
+			}
+		}
+	}
+	return
+}
+
+// buildRule parses line against the given proxies, sub-rules and rule providers
+// the same way the config parser does.
+func buildRule(line string, hasProxy func(name string) bool, subRules map[string][]constant.Rule, hasRuleProvider func(name string) bool) (constant.Rule, error) {
+	ruleName, payload, target, params, err := splitRuleLine(line)
+	if err != nil {
+		return nil, err
+	}
+	if !hasProxy(target) {
+		if _, ok := subRules[target]; ruleName != "SUB-RULE" {
+			return nil, fmt.Errorf("proxy [%s] not found", target)
+		} else if !ok {
+			return nil, fmt.Errorf("sub-rule [%s] not found", target)
+		}
+	}
+	parsed, err := R.ParseRule(ruleName, payload, target, params, subRules)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range parsed.ProviderNames() {
+		if !hasRuleProvider(name) {
+			return nil, fmt.Errorf("rule set [%s] not found", name)
+		}
+	}
+	return parsed, nil
+}
+
+func parseRuleLine(line string) (constant.Rule, error) {
+	var subRules map[string][]constant.Rule
+	if currentConfig != nil {
+		subRules = currentConfig.SubRules
+	}
+	return buildRule(line, func(name string) bool {
+		_, ok := tunnel.Proxies()[name]
+		return ok
+	}, subRules, func(name string) bool {
+		_, ok := tunnel.RuleProviders()[name]
+		return ok
+	})
+}
+
+// profileRules returns the running rules without the access control ones,
+// runLock must be held.
+func profileRules() []constant.Rule {
+	rules := tunnel.Rules()
+	if appRuleCount > len(rules) {
+		return rules[len(rules):]
+	}
+	return rules[appRuleCount:]
+}
+
+func ruleString(rule constant.Rule) string {
+	return ruleKey(rule.RuleType().String(), rule.Payload(), rule.Adapter())
+}
+
+// profileRuleId is the overlay id of the rule at index of the profile, rules
+// added by the overlay have the id of their insert item.
+func profileRuleId(index int) string {
+	return "profile-" + strconv.Itoa(index)
+}
+
+func clampIndex(index int, length int) int {
+	if index < 0 {
+		return 0
+	}
+	if index > length {
+		return length
+	}
+	return index
+}
+
+// overlayEntry is a rule of the overlaid rules, either the rule at base of
+// the profile or the rule added by item.
+type overlayEntry struct {
+	id   string
+	base int
+	item *RuleOverlayItem
+}
+
+// replayRuleOverlay applies the live items to the profile rules with the
+// given keys. Inserts rejected by valid are skipped, as are edits whose rule
+// is gone.
+func replayRuleOverlay(items []*RuleOverlayItem, keys []string, now time.Time, valid func(item *RuleOverlayItem) bool) []overlayEntry {
+	entries := make([]overlayEntry, len(keys))
+	for i := range keys {
+		entries[i] = overlayEntry{id: profileRuleId(i), base: i}
+	}
+	indexOf := func(item *RuleOverlayItem) int {
+		for i, entry := range entries {
+			if entry.id != item.Target {
+				continue
+			}
+			if entry.item == nil && keys[entry.base] != item.Rule {
+				return -1
+			}
+			return i
+		}
+		return -1
+	}
+	for _, item := range items {
+		if item.ExpireAt != nil && !item.ExpireAt.After(now) {
+			continue
+		}
+		switch item.Op {
+		case insertRuleOp:
+			if !valid(item) {
+				continue
+			}
+			index := clampIndex(item.Index, len(entries))
+			entry := overlayEntry{id: item.Id, base: -1, item: item}
+			entries = append(entries[:index], append([]overlayEntry{entry}, entries[index:]...)...)
+		case removeRuleOp:
+			if index := indexOf(item); index != -1 {
+				entries = append(entries[:index], entries[index+1:]...)
+			}
+		case moveRuleOp:
+			if index := indexOf(item); index != -1 {
+				entry := entries[index]
+				entries = append(entries[:index], entries[index+1:]...)
+				to := clampIndex(item.Index, len(entries))
+				entries = append(entries[:to], append([]overlayEntry{entry}, entries[to:]...)...)
+			}
+		}
+	}
+	return entries
+}
+
+// applyRuleOverlay rebuilds the tunnel rules from the parsed config plus the
+// overlay of the current profile, runLock must be held by the caller.
+func applyRuleOverlay() {
+	if currentConfig == nil {
+		return
+	}
+	if ruleOverlayTimer != nil {
+		ruleOverlayTimer.Stop()
+		ruleOverlayTimer = nil
+	}
+	now := time.Now()
+	var nextExpire *time.Time
+	items := ruleOverlay.Items[:0]
+	for _, item := range ruleOverlay.Items {
+		if item.ExpireAt != nil && !item.ExpireAt.After(now) {
+			continue
+		}
+		items = append(items, item)
+	}
+	if pruned := len(ruleOverlay.Items) - len(items); pruned > 0 {
+		ruleOverlay.Items = items
+		if err := saveRuleOverlay(); err != nil {
+			log.Warnln("[Rule] save overlay error: %v", err)
+		}
+	}
+	for _, item := range ruleOverlay.Items {
+		if item.ExpireAt != nil && (nextExpire == nil || item.ExpireAt.Before(*nextExpire)) {
+			nextExpire = item.ExpireAt
+		}
+	}
+	keys := make([]string, len(currentConfig.Rules))
+	for i, rule := range currentConfig.Rules {
+		keys[i] = ruleString(rule)
+	}
+	inserted := map[*RuleOverlayItem]constant.Rule{}
+	entries := replayRuleOverlay(ruleOverlay.Items, keys, now, func(item *RuleOverlayItem) bool {
+		rule, err := parseRuleLine(item.Rule)
+		if err != nil {
+			log.Warnln("[Rule] skip overlay rule %s: %v", item.Rule, err)
+			return false
+		}
+		inserted[item] = rule
+		return true
+	})
+	app := appRules(state.Get().AppAccessControl)
+	appRuleCount = len(app)
+	rules := make([]constant.Rule, 0, len(app)+len(entries))
+	rules = append(rules, app...)
+	ruleOverlayIds = make([]string, len(entries))
+	for i, entry := range entries {
+		ruleOverlayIds[i] = entry.id
+		if entry.item != nil {
+			rules = append(rules, inserted[entry.item])
+		} else {
+			rules = append(rules, currentConfig.Rules[entry.base])
+		}
+	}
+	tunnel.UpdateRules(rules, currentConfig.SubRules, currentConfig.RuleProviders)
+	if nextExpire != nil {
+		ruleOverlayTimer = time.AfterFunc(time.Until(*nextExpire), func() {
+			runLock.Lock()
+			defer runLock.Unlock()
+			applyRuleOverlay()
+		})
+	}
+}
+
+// reloadRuleOverlay switches the overlay to the current profile and applies it.
+func reloadRuleOverlay() {
+	if profile := state.Get().CurrentProfileName; profile != ruleOverlay.Profile {
+		ruleOverlay = loadRuleOverlay(profile)
+	}
+	applyRuleOverlay()
+}
+
+// pushRuleOverlayItem appends items as one change, they share an id so they
+// are deleted together.
+func pushRuleOverlayItem(items ...*RuleOverlayItem) error {
+	id := utils.NewUUIDV4().String()
+	for _, item := range items {
+		item.Id = id
+		ruleOverlay.Items = append(ruleOverlay.Items, item)
+	}
+	applyRuleOverlay()
+	return saveRuleOverlay()
+}
+
+func ruleExpireAt(ttl int64) *time.Time {
+	if ttl <= 0 {
+		return nil
+	}
+	expireAt := time.Now().Add(time.Duration(ttl) * time.Second)
+	return &expireAt
+}
+
+func insertRule(params *InsertRuleParams) (string, error) {
+	rule, err := parseRuleLine(params.Rule)
+	if err != nil {
+		return "", err
+	}
+	item := &RuleOverlayItem{
+		Op:       insertRuleOp,
+		Rule:     params.Rule,
+		Index:    params.Index,
+		ExpireAt: ruleExpireAt(params.TTL),
+	}
+	log.Infoln("[Rule] insert %s at %d", ruleString(rule), params.Index)
+	err = pushRuleOverlayItem(item)
+	return item.Id, err
+}
+
+// profileRuleAt returns the key and the overlay id of the running profile
+// rule at index.
+func profileRuleAt(index int) (string, string, error) {
+	rules := profileRules()
+	if index < 0 || index >= len(rules) || index >= len(ruleOverlayIds) {
+		return "", "", errors.New("rule index out of range")
+	}
+	return ruleString(rules[index]), ruleOverlayIds[index], nil
+}
+
+// overrideRule replaces the rule at params.Index, with a ttl the replaced
+// rule comes back once it expires.
+func overrideRule(params *InsertRuleParams) (string, error) {
+	key, id, err := profileRuleAt(params.Index)
+	if err != nil {
+		return "", err
+	}
+	rule, err := parseRuleLine(params.Rule)
+	if err != nil {
+		return "", err
+	}
+	expireAt := ruleExpireAt(params.TTL)
+	remove := &RuleOverlayItem{
+		Op:       removeRuleOp,
+		Rule:     key,
+		Target:   id,
+		ExpireAt: expireAt,
+	}
+	insert := &RuleOverlayItem{
+		Op:       insertRuleOp,
+		Rule:     params.Rule,
+		Index:    params.Index,
+		ExpireAt: expireAt,
+	}
+	log.Infoln("[Rule] override %s with %s", remove.Rule, ruleString(rule))
+	err = pushRuleOverlayItem(remove, insert)
+	return insert.Id, err
+}
+
+// removeRule removes the rule at params.Index. A rule added by the overlay
+// is removed by dropping its insert item together with the edits of it, the
+// other items of the same change, such as the removal of an overridden rule,
+// are kept.
+func removeRule(params *RemoveRuleParams) error {
+	key, id, err := profileRuleAt(params.Index)
+	if err != nil {
+		return err
+	}
+	for _, item := range ruleOverlay.Items {
+		if item.Op == insertRuleOp && item.Id == id {
+			return dropRuleOverlayItems(func(item *RuleOverlayItem) bool {
+				return (item.Op == insertRuleOp && item.Id == id) || item.Target == id
+			})
+		}
+	}
+	return pushRuleOverlayItem(&RuleOverlayItem{
+		Op:     removeRuleOp,
+		Rule:   key,
+		Target: id,
+	})
+}
+
+func moveRule(params *MoveRuleParams) error {
+	key, id, err := profileRuleAt(params.From)
+	if err != nil {
+		return err
+	}
+	return pushRuleOverlayItem(&RuleOverlayItem{
+		Op:     moveRuleOp,
+		Rule:   key,
+		Target: id,
+		Index:  params.To,
+	})
+}
+
+// dropRuleOverlayItems deletes the items matching drop and applies the rest.
+func dropRuleOverlayItems(drop func(item *RuleOverlayItem) bool) error {
+	items := make([]*RuleOverlayItem, 0, len(ruleOverlay.Items))
+	for _, item := range ruleOverlay.Items {
+		if !drop(item) {
+			items = append(items, item)
+		}
+	}
+	if len(items) == len(ruleOverlay.Items) {
+		return errors.New("overlay item not found")
+	}
+	ruleOverlay.Items = items
+	applyRuleOverlay()
+	return saveRuleOverlay()
+}
+
+// deleteRuleOverlayItem deletes the change with id and the edits of the rule
+// it inserted.
+func deleteRuleOverlayItem(id string) error {
+	return dropRuleOverlayItems(func(item *RuleOverlayItem) bool {
+		return item.Id == id || item.Target == id
+	})
+}
+
+func clearRuleOverlay() error {
+	ruleOverlay.Items = []*RuleOverlayItem{}
+	applyRuleOverlay()
+	return saveRuleOverlay()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func runningRuleKeys() []string {
+	runLock.Lock()
+	defer runLock.Unlock()
+	keys := []string{}
+	for _, rule := range profileRules() {
+		keys = append(keys, ruleString(rule))
+	}
+	return keys
+}
+
+func checkRunningRules(t *testing.T, step string, want ...string) {
+	t.Helper()
+	if keys := runningRuleKeys(); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("%s: rules %v, want %v", step, keys, want)
+	}
+}
+
+func TestRuleOverlayEdits(t *testing.T) {
+	lines := []string{"DOMAIN,a.test,DIRECT", "DOMAIN,dup.test,DIRECT", "DOMAIN,dup.test,DIRECT", "MATCH,proxy"}
+	setupRuleTest(t, lines...)
+	lock := func() func() {
+		runLock.Lock()
+		return runLock.Unlock
+	}
+
+	unlock := lock()
+	_, err := insertRule(&InsertRuleParams{Rule: "DOMAIN,new.test,proxy", Index: 0})
+	unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRunningRules(t, "insert", "Domain,new.test,proxy", "Domain,a.test,DIRECT", "Domain,dup.test,DIRECT", "Domain,dup.test,DIRECT", "Match,,proxy")
+
+	// duplicates share their key, the second one is removed by its position
+	unlock = lock()
+	err = removeRule(&RemoveRuleParams{Index: 3})
+	unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item := ruleOverlay.Items[1]; item.Op != removeRuleOp || item.Target != profileRuleId(2) {
+		t.Fatalf("remove item = %+v", item)
+	}
+	checkRunningRules(t, "remove duplicate", "Domain,new.test,proxy", "Domain,a.test,DIRECT", "Domain,dup.test,DIRECT", "Match,,proxy")
+
+	unlock = lock()
+	overrideId, err := overrideRule(&InsertRuleParams{Rule: "DOMAIN,a.test,REJECT", Index: 1})
+	unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRunningRules(t, "override", "Domain,new.test,proxy", "Domain,a.test,REJECT", "Domain,dup.test,DIRECT", "Match,,proxy")
+
+	// removing the overriding rule keeps the overridden one removed
+	unlock = lock()
+	err = removeRule(&RemoveRuleParams{Index: 1})
+	unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRunningRules(t, "remove override", "Domain,new.test,proxy", "Domain,dup.test,DIRECT", "Match,,proxy")
+
+	unlock = lock()
+	err = moveRule(&MoveRuleParams{From: 0, To: 2})
+	unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRunningRules(t, "move", "Domain,dup.test,DIRECT", "Match,,proxy", "Domain,new.test,proxy")
+
+	unlock = lock()
+	exported := overlayRuleLines(lines, currentConfig.Rules)
+	unlock()
+	if want := []string{"DOMAIN,dup.test,DIRECT", "MATCH,proxy", "DOMAIN,new.test,proxy"}; !reflect.DeepEqual(exported, want) {
+		t.Fatalf("exported rules %v, want %v", exported, want)
+	}
+
+	// removing an inserted rule drops its insert and the edits of it
+	unlock = lock()
+	err = removeRule(&RemoveRuleParams{Index: 2})
+	unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRunningRules(t, "remove inserted", "Domain,dup.test,DIRECT", "Match,,proxy")
+	if len(ruleOverlay.Items) != 2 {
+		t.Fatalf("%d overlay items left, want the duplicate removal and the override removal", len(ruleOverlay.Items))
+	}
+
+	unlock = lock()
+	err = deleteRuleOverlayItem(overrideId)
+	unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRunningRules(t, "delete override", "Domain,a.test,DIRECT", "Domain,dup.test,DIRECT", "Match,,proxy")
+
+	unlock = lock()
+	ruleOverlay.Items[0].ExpireAt = &time.Time{}
+	applyRuleOverlay()
+	unlock()
+	if len(ruleOverlay.Items) != 0 {
+		t.Fatalf("expired items kept: %+v", ruleOverlay.Items)
+	}
+	checkRunningRules(t, "expire", "Domain,a.test,DIRECT", "Domain,dup.test,DIRECT", "Domain,dup.test,DIRECT", "Match,,proxy")
+}
+
+func TestReplayRuleOverlayChangedProfile(t *testing.T) {
+	items := []*RuleOverlayItem{
+		{Id: "1", Op: removeRuleOp, Rule: "Domain,b.test,DIRECT", Target: profileRuleId(1)},
+		{Id: "2", Op: moveRuleOp, Rule: "Domain,a.test,DIRECT", Target: profileRuleId(0), Index: 1},
+	}
+	valid := func(*RuleOverlayItem) bool {
+		return true
+	}
+	entries := replayRuleOverlay(items, []string{"Domain,a.test,DIRECT", "Domain,c.test,DIRECT"}, time.Now(), valid)
+	if len(entries) != 2 || entries[0].base != 1 || entries[1].base != 0 {
+		t.Fatalf("entries = %+v, want the stale removal skipped and the move applied", entries)
+	}
+}
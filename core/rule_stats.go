@@ -0,0 +1,294 @@
+package main
+
+import (
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/tunnel"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"sort"
+	"sync"
+	"time"
+)
+
+type RuleStatsParams struct {
+	Sort  string `json:"sort"`
+	Desc  bool   `json:"desc"`
+	Limit int    `json:"limit"`
+}
+
+type UnusedRulesParams struct {
+	Since *time.Time `json:"since"`
+}
+
+// RuleStat reports the hits of a running rule. Connections only carry the
+// type, payload and proxy of their rule, so when several running rules share
+// them and the connection matches more than one of them, the hit is counted
+// as AmbiguousHits on each of them instead of being guessed.
+type RuleStat struct {
+	Index         int        `json:"index"`
+	Rule          string     `json:"rule"`
+	Payload       string     `json:"payload"`
+	Proxy         string     `json:"proxy"`
+	Hits          int64      `json:"hits"`
+	AmbiguousHits int64      `json:"ambiguous-hits"`
+	LastHit       *time.Time `json:"last-hit"`
+}
+
+type RuleProviderStat struct {
+	Name    string     `json:"name"`
+	Hits    int64      `json:"hits"`
+	LastHit *time.Time `json:"last-hit"`
+}
+
+type UnusedRulesReport struct {
+	Since         time.Time           `json:"since"`
+	CollectSince  time.Time           `json:"collect-since"`
+	Rules         []*RuleStat         `json:"rules"`
+	RuleProviders []*RuleProviderStat `json:"rule-providers"`
+}
+
+type ruleHit struct {
+	hits    int64
+	lastHit time.Time
+}
+
+func (h *ruleHit) add() {
+	h.hits++
+	h.lastHit = time.Now()
+}
+
+// ruleStatsStore counts hits per rule instance, so duplicated rules at other
+// positions keep their own counters. Hits that can't be told apart between
+// rules with the same key are counted per key.
+type ruleStatsStore struct {
+	sync.Mutex
+	since     time.Time
+	hits      map[constant.Rule]*ruleHit
+	ambiguous map[string]*ruleHit
+	// rules maps the keys of the running rules to the rules with the key in
+	// matching order.
+	rules     map[string][]constant.Rule
+	rulesHead *constant.Rule
+	rulesLen  int
+}
+
+var ruleStats = &ruleStatsStore{
+	since:     time.Now(),
+	hits:      map[constant.Rule]*ruleHit{},
+	ambiguous: map[string]*ruleHit{},
+}
+
+func ruleKey(ruleType string, payload string, proxy string) string {
+	return ruleType + "," + payload + "," + proxy
+}
+
+// candidates returns the running rules with key, the lock must be held.
+func (s *ruleStatsStore) candidates(key string) []constant.Rule {
+	rules := tunnel.Rules()
+	if len(rules) == 0 {
+		return nil
+	}
+	if s.rules == nil || s.rulesHead != &rules[0] || s.rulesLen != len(rules) {
+		s.rules = make(map[string][]constant.Rule, len(rules))
+		for _, rule := range rules {
+			key := ruleString(rule)
+			s.rules[key] = append(s.rules[key], rule)
+		}
+		s.rulesHead = &rules[0]
+		s.rulesLen = len(rules)
+		s.prune(rules)
+	}
+	return s.rules[key]
+}
+
+// resolve returns the running rule a connection was matched by. Rules sharing
+// the key are told apart by matching the connection against them again, nil
+// is returned when that is not conclusive. The lock must be held.
+func (s *ruleStatsStore) resolve(candidates []constant.Rule, metadata *constant.Metadata) constant.Rule {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	if metadata == nil {
+		return nil
+	}
+	var resolved constant.Rule
+	for _, rule := range candidates {
+		// rules may rewrite the metadata while matching, which is shared
+		// with the connection
+		copied := *metadata
+		if matched, _ := rule.Match(&copied); matched {
+			if resolved != nil {
+				return nil
+			}
+			resolved = rule
+		}
+	}
+	return resolved
+}
+
+// prune drops the counters of rules that are no longer running.
+func (s *ruleStatsStore) prune(rules []constant.Rule) {
+	running := make(map[constant.Rule]bool, len(rules))
+	for _, rule := range rules {
+		running[rule] = true
+	}
+	for rule := range s.hits {
+		if !running[rule] {
+			delete(s.hits, rule)
+		}
+	}
+	for key := range s.ambiguous {
+		if len(s.rules[key]) < 2 {
+			delete(s.ambiguous, key)
+		}
+	}
+}
+
+func (s *ruleStatsStore) Record(c statistic.Tracker) {
+	info := c.Info()
+	if info == nil || info.Rule == "" || len(info.Chain) == 0 {
+		return
+	}
+	key := ruleKey(info.Rule, info.RulePayload, info.Chain[len(info.Chain)-1])
+	s.Lock()
+	defer s.Unlock()
+	candidates := s.candidates(key)
+	if len(candidates) == 0 {
+		return
+	}
+	rule := s.resolve(candidates, info.Metadata)
+	if rule == nil {
+		hit, ok := s.ambiguous[key]
+		if !ok {
+			hit = &ruleHit{}
+			s.ambiguous[key] = hit
+		}
+		hit.add()
+		return
+	}
+	hit, ok := s.hits[rule]
+	if !ok {
+		hit = &ruleHit{}
+		s.hits[rule] = hit
+	}
+	hit.add()
+}
+
+func (s *ruleStatsStore) Reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.since = time.Now()
+	s.hits = map[constant.Rule]*ruleHit{}
+	s.ambiguous = map[string]*ruleHit{}
+}
+
+func (s *ruleStatsStore) Stats(rules []constant.Rule) []*RuleStat {
+	s.Lock()
+	defer s.Unlock()
+	stats := make([]*RuleStat, 0, len(rules))
+	for index, rule := range rules {
+		stat := &RuleStat{
+			Index:   index,
+			Rule:    rule.RuleType().String(),
+			Payload: rule.Payload(),
+			Proxy:   rule.Adapter(),
+		}
+		if hit, ok := s.hits[rule]; ok {
+			lastHit := hit.lastHit
+			stat.Hits = hit.hits
+			stat.LastHit = &lastHit
+		}
+		// ambiguous hits may belong to any rule with the key, so they count
+		// as a use of each of them
+		if hit, ok := s.ambiguous[ruleString(rule)]; ok {
+			stat.AmbiguousHits = hit.hits
+			if stat.LastHit == nil || stat.LastHit.Before(hit.lastHit) {
+				lastHit := hit.lastHit
+				stat.LastHit = &lastHit
+			}
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+func getRuleStats(params *RuleStatsParams) []*RuleStat {
+	stats := ruleStats.Stats(profileRules())
+	var less func(a, b *RuleStat) bool
+	switch params.Sort {
+	case "hits":
+		less = func(a, b *RuleStat) bool {
+			return a.Hits < b.Hits
+		}
+	case "last-hit":
+		less = func(a, b *RuleStat) bool {
+			if a.LastHit == nil || b.LastHit == nil {
+				return a.LastHit == nil && b.LastHit != nil
+			}
+			return a.LastHit.Before(*b.LastHit)
+		}
+	default:
+		less = func(a, b *RuleStat) bool {
+			return a.Index < b.Index
+		}
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		if params.Desc {
+			return less(stats[j], stats[i])
+		}
+		return less(stats[i], stats[j])
+	})
+	if params.Limit > 0 && params.Limit < len(stats) {
+		stats = stats[:params.Limit]
+	}
+	return stats
+}
+
+func getUnusedRules(params *UnusedRulesParams) *UnusedRulesReport {
+	rules := profileRules()
+	stats := ruleStats.Stats(rules)
+	ruleStats.Lock()
+	report := &UnusedRulesReport{
+		Since:         ruleStats.since,
+		CollectSince:  ruleStats.since,
+		Rules:         []*RuleStat{},
+		RuleProviders: []*RuleProviderStat{},
+	}
+	ruleStats.Unlock()
+	if params.Since != nil && params.Since.After(report.Since) {
+		report.Since = *params.Since
+	}
+	used := func(lastHit *time.Time) bool {
+		return lastHit != nil && !lastHit.Before(report.Since)
+	}
+	providerStats := map[string]*RuleProviderStat{}
+	for name := range tunnel.RuleProviders() {
+		providerStats[name] = &RuleProviderStat{
+			Name: name,
+		}
+	}
+	for index, stat := range stats {
+		if !used(stat.LastHit) {
+			report.Rules = append(report.Rules, stat)
+			continue
+		}
+		for _, name := range rules[index].ProviderNames() {
+			providerStat, ok := providerStats[name]
+			if !ok {
+				continue
+			}
+			providerStat.Hits += stat.Hits
+			if providerStat.LastHit == nil || providerStat.LastHit.Before(*stat.LastHit) {
+				providerStat.LastHit = stat.LastHit
+			}
+		}
+	}
+	for _, providerStat := range providerStats {
+		if !used(providerStat.LastHit) {
+			report.RuleProviders = append(report.RuleProviders, providerStat)
+		}
+	}
+	sort.Slice(report.RuleProviders, func(i, j int) bool {
+		return report.RuleProviders[i].Name < report.RuleProviders[j].Name
+	})
+	return report
+}
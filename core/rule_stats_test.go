@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/tunnel"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"testing"
+)
+
+// testRule is a DOMAIN rule matching the hosts in match.
+type testRule struct {
+	payload string
+	adapter string
+	match   map[string]bool
+}
+
+func (r *testRule) RuleType() constant.RuleType {
+	return constant.Domain
+}
+
+func (r *testRule) Match(metadata *constant.Metadata) (bool, string) {
+	return r.match[metadata.Host], r.adapter
+}
+
+func (r *testRule) Adapter() string {
+	return r.adapter
+}
+
+func (r *testRule) Payload() string {
+	return r.payload
+}
+
+func (r *testRule) ShouldResolveIP() bool {
+	return false
+}
+
+func (r *testRule) ShouldFindProcess() bool {
+	return false
+}
+
+func (r *testRule) ProviderNames() []string {
+	return nil
+}
+
+type testTracker struct {
+	statistic.Tracker
+	info *statistic.TrackerInfo
+}
+
+func (t *testTracker) Info() *statistic.TrackerInfo {
+	return t.info
+}
+
+func newTestTracker(rule constant.Rule, host string) statistic.Tracker {
+	return &testTracker{info: &statistic.TrackerInfo{
+		Metadata:    &constant.Metadata{Host: host},
+		Chain:       constant.Chain{"node", rule.Adapter()},
+		Rule:        rule.RuleType().String(),
+		RulePayload: rule.Payload(),
+	}}
+}
+
+func TestRuleStatsRecord(t *testing.T) {
+	first := &testRule{payload: "shared", adapter: "proxy", match: map[string]bool{"a.test": true}}
+	second := &testRule{payload: "shared", adapter: "proxy", match: map[string]bool{"b.test": true}}
+	duplicate := &testRule{payload: "twice", adapter: "proxy", match: map[string]bool{"c.test": true}}
+	rules := []constant.Rule{first, second, duplicate, &testRule{payload: "twice", adapter: "proxy", match: map[string]bool{"c.test": true}}}
+	tunnel.UpdateRules(rules, nil, nil)
+	t.Cleanup(func() {
+		tunnel.UpdateRules(nil, nil, nil)
+	})
+	store := &ruleStatsStore{
+		hits:      map[constant.Rule]*ruleHit{},
+		ambiguous: map[string]*ruleHit{},
+	}
+
+	store.Record(newTestTracker(second, "b.test"))
+	store.Record(newTestTracker(second, "b.test"))
+	store.Record(newTestTracker(duplicate, "c.test"))
+	store.Record(newTestTracker(&testRule{payload: "gone", adapter: "proxy"}, "d.test"))
+
+	stats := store.Stats(rules)
+	for index, want := range []struct {
+		hits      int64
+		ambiguous int64
+	}{{0, 0}, {2, 0}, {0, 1}, {0, 1}} {
+		stat := stats[index]
+		if stat.Hits != want.hits || stat.AmbiguousHits != want.ambiguous || (stat.LastHit != nil) != (want.hits+want.ambiguous > 0) {
+			t.Errorf("rule %d: %+v, want %d hits and %d ambiguous hits", index, stat, want.hits, want.ambiguous)
+		}
+	}
+
+	// a reload drops the counters of rules that are no longer running
+	tunnel.UpdateRules([]constant.Rule{first, duplicate}, nil, nil)
+	store.Record(newTestTracker(first, "a.test"))
+	stats = store.Stats([]constant.Rule{first, duplicate})
+	if stats[0].Hits != 1 || stats[1].Hits != 0 || stats[1].AmbiguousHits != 0 || stats[1].LastHit != nil {
+		t.Fatalf("stats after reload = %+v %+v", stats[0], stats[1])
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"github.com/metacubex/mihomo/component/process"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/tunnel"
+	"net/netip"
+	"testing"
+)
+
+// setupRuleTest runs a config with the given rules and a socks proxy
+// named proxy.
+func setupRuleTest(t *testing.T, rules ...string) {
+	t.Helper()
+	useTestHomeDir(t)
+	params := defaultSetupParams()
+	params.Config.Rule = rules
+	params.Config.Proxy = []map[string]any{
+		{"name": "proxy", "type": "socks5", "server": "127.0.0.1", "port": 1080},
+	}
+	cfg, err := config.ParseRawConfig(params.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runLock.Lock()
+	tunnel.UpdateProxies(cfg.Proxies, cfg.Providers)
+	tunnel.SetFindProcessMode(process.FindProcessStrict)
+	currentConfig = cfg
+	ruleOverlay = &RuleOverlay{Items: []*RuleOverlayItem{}}
+	applyRuleOverlay()
+	runLock.Unlock()
+	t.Cleanup(func() {
+		_ = updateState(`{"app-access-control":null}`)
+		runLock.Lock()
+		defer runLock.Unlock()
+		currentConfig = nil
+		appRuleCount = 0
+		tunnel.UpdateRules(nil, nil, nil)
+	})
+}
+
+// lockCheckResolver answers every lookup with ip and records whether runLock
+// was free while resolving.
+type lockCheckResolver struct {
+	resolver.Resolver
+	ip       netip.Addr
+	lookups  int
+	unlocked bool
+}
+
+func (r *lockCheckResolver) lookup() []netip.Addr {
+	r.lookups++
+	if runLock.TryLock() {
+		r.unlocked = true
+		runLock.Unlock()
+	}
+	return []netip.Addr{r.ip}
+}
+
+func (r *lockCheckResolver) LookupIP(context.Context, string) ([]netip.Addr, error) {
+	return r.lookup(), nil
+}
+
+func (r *lockCheckResolver) LookupIPv4(context.Context, string) ([]netip.Addr, error) {
+	return r.lookup(), nil
+}
+
+func (r *lockCheckResolver) LookupIPv6(context.Context, string) ([]netip.Addr, error) {
+	return r.lookup(), nil
+}
+
+func (r *lockCheckResolver) Invalid() bool {
+	return true
+}
+
+func TestExplainRule(t *testing.T) {
+	setupRuleTest(t, "DOMAIN-SUFFIX,example.com,proxy", "IP-CIDR,192.0.2.0/24,REJECT", "MATCH,DIRECT")
+	stub := &lockCheckResolver{ip: netip.MustParseAddr("192.0.2.7")}
+	defaultResolver := resolver.DefaultResolver
+	resolver.DefaultResolver = stub
+	t.Cleanup(func() {
+		resolver.DefaultResolver = defaultResolver
+	})
+
+	result, err := explainRule(&ExplainRuleParams{Host: "www.example.com", DstPort: 443})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Proxy != "proxy" || result.Index != 0 || result.Rule != "DomainSuffix" || len(result.DNS) != 0 {
+		t.Fatalf("explain www.example.com = %+v", result)
+	}
+
+	result, err = explainRule(&ExplainRuleParams{Host: "other.test", DstPort: 443})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Proxy != "REJECT" || result.Index != 1 || len(result.DNS) != 1 || result.DNS[0].IP != stub.ip {
+		t.Fatalf("explain other.test = %+v", result)
+	}
+	if stub.lookups != 1 || !stub.unlocked {
+		t.Fatalf("resolved %d times, runLock free: %v", stub.lookups, stub.unlocked)
+	}
+
+	if _, err = explainRule(&ExplainRuleParams{DstPort: 443}); err == nil {
+		t.Fatal("explained a request without host and dst-ip")
+	}
+}
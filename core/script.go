@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dop251/goja"
+	"github.com/dop251/goja/parser"
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"regexp"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultScriptTimeout     = time.Second * 5
+	scriptMemoryLimit        = 64 * 1024 * 1024
+	scriptMemoryWatchTicker  = time.Millisecond * 10
+	scriptMaxCallStackSize   = 1024
+	scriptEntryFunction      = "main"
+	scriptDiagnosticPathRoot = "script"
+)
+
+var (
+	scriptPositionRegexp = regexp.MustCompile(`:(\d+):(\d+)`)
+	scriptSyntaxRegexp   = regexp.MustCompile(`Line (\d+):(\d+)`)
+)
+
+type scriptError struct {
+	diagnostic *Diagnostic
+}
+
+func (e *scriptError) Error() string {
+	if e.diagnostic.Line != 0 {
+		return fmt.Sprintf("%s:%d:%d %s", e.diagnostic.Path, e.diagnostic.Line, e.diagnostic.Column, e.diagnostic.Message)
+	}
+	return fmt.Sprintf("%s %s", e.diagnostic.Path, e.diagnostic.Message)
+}
+
+func newScriptError(path string, err error) *scriptError {
+	diagnostic := &Diagnostic{
+		Severity: ErrorSeverity,
+		Path:     scriptDiagnosticPathRoot + "." + path,
+		Message:  err.Error(),
+	}
+	var parseErrors parser.ErrorList
+	var syntaxError *goja.CompilerSyntaxError
+	var exception *goja.Exception
+	var interrupted *goja.InterruptedError
+	switch {
+	case errors.As(err, &parseErrors) && len(parseErrors) > 0:
+		diagnostic.Message = parseErrors[0].Message
+		diagnostic.Line = parseErrors[0].Position.Line
+		diagnostic.Column = parseErrors[0].Position.Column
+		return &scriptError{diagnostic: diagnostic}
+	case errors.As(err, &syntaxError):
+		diagnostic.Message = syntaxError.Message
+		if syntaxError.File != nil {
+			position := syntaxError.File.Position(syntaxError.Offset)
+			diagnostic.Line = position.Line
+			diagnostic.Column = position.Column
+		} else if match := scriptSyntaxRegexp.FindStringSubmatch(syntaxError.Message); match != nil {
+			// the compiler only puts the position into the message
+			diagnostic.Line, _ = strconv.Atoi(match[1])
+			diagnostic.Column, _ = strconv.Atoi(match[2])
+		}
+		return &scriptError{diagnostic: diagnostic}
+	case errors.As(err, &interrupted):
+		diagnostic.Message = fmt.Sprint(interrupted.Value())
+	case errors.As(err, &exception):
+		diagnostic.Message = exception.Value().String()
+	}
+	if match := scriptPositionRegexp.FindStringSubmatch(err.Error()); match != nil {
+		diagnostic.Line, _ = strconv.Atoi(match[1])
+		diagnostic.Column, _ = strconv.Atoi(match[2])
+	}
+	return &scriptError{diagnostic: diagnostic}
+}
+
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+// heapObjects returns the bytes of the heap objects, which includes garbage
+// not collected yet. Reading it does not stop the world.
+func heapObjects() uint64 {
+	sample := []metrics.Sample{{Name: heapObjectsMetric}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
+
+// watchScript interrupts vm when it runs longer than timeout or the heap
+// grows more than limit while it runs, the returned func stops watching. The
+// heap is shared with the rest of the core, so a collection confirms the
+// growth before the script is blamed.
+func watchScript(vm *goja.Runtime, timeout time.Duration, limit uint64) func() {
+	done := make(chan struct{})
+	base := heapObjects()
+	go func() {
+		ticker := time.NewTicker(scriptMemoryWatchTicker)
+		defer ticker.Stop()
+		deadline := time.NewTimer(timeout)
+		defer deadline.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-deadline.C:
+				vm.Interrupt(fmt.Sprintf("timeout after %v", timeout))
+				return
+			case <-ticker.C:
+				if heapObjects() < base+limit {
+					continue
+				}
+				runtime.GC()
+				if heapObjects() >= base+limit {
+					vm.Interrupt("memory limit exceeded")
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// limitScriptAllocations removes the binary buffers and caps the string
+// builtins that allocate their whole result at once, a single call could
+// exhaust the memory before the watcher notices.
+const limitScriptAllocations = `(function (limit) {
+	for (const name of ["ArrayBuffer", "SharedArrayBuffer", "DataView", "Int8Array", "Uint8Array",
+		"Uint8ClampedArray", "Int16Array", "Uint16Array", "Int32Array", "Uint32Array",
+		"Float32Array", "Float64Array", "BigInt64Array", "BigUint64Array"]) {
+		delete globalThis[name];
+	}
+	const check = function (length) {
+		if (length > limit) {
+			throw new RangeError("memory limit exceeded");
+		}
+	};
+	const repeat = String.prototype.repeat;
+	const padStart = String.prototype.padStart;
+	const padEnd = String.prototype.padEnd;
+	Object.defineProperties(String.prototype, {
+		repeat: {
+			value: function (count) {
+				check(String(this).length * count);
+				return repeat.call(this, count);
+			}, writable: true, configurable: true,
+		},
+		padStart: {
+			value: function (length, fill) {
+				check(length);
+				return padStart.call(this, length, fill);
+			}, writable: true, configurable: true,
+		},
+		padEnd: {
+			value: function (length, fill) {
+				check(length);
+				return padEnd.call(this, length, fill);
+			}, writable: true, configurable: true,
+		},
+	});
+})`
+
+func newScriptRuntime() (*goja.Runtime, error) {
+	vm := goja.New()
+	vm.SetMaxCallStackSize(scriptMaxCallStackSize)
+	console := vm.NewObject()
+	print := func(logFn func(format string, v ...any)) func(call goja.FunctionCall) goja.Value {
+		return func(call goja.FunctionCall) goja.Value {
+			args := make([]string, 0, len(call.Arguments))
+			for _, arg := range call.Arguments {
+				args = append(args, arg.String())
+			}
+			logFn("[Script] %s", strings.Join(args, " "))
+			return goja.Undefined()
+		}
+	}
+	_ = console.Set("log", print(log.Infoln))
+	_ = console.Set("warn", print(log.Warnln))
+	_ = console.Set("error", print(log.Errorln))
+	_ = vm.Set("console", console)
+	value, err := vm.RunString(limitScriptAllocations)
+	if err != nil {
+		return nil, err
+	}
+	limit, _ := goja.AssertFunction(value)
+	if _, err = limit(goja.Undefined(), vm.ToValue(scriptMemoryLimit)); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// runConfigScript runs main(config) of the script at path in the home dir
+// and returns the config it produces. The interpreter has no access to the
+// file system or network and is stopped past its time and memory budget.
+func runConfigScript(path string, raw *config.RawConfig, timeout time.Duration) (*config.RawConfig, error) {
+	fullPath := constant.Path.Resolve(path)
+	if !constant.Path.IsSafePath(fullPath) {
+		return nil, newScriptError(path, errors.New("path is not in home dir"))
+	}
+	source, err := readFile(fullPath)
+	if err != nil {
+		return nil, newScriptError(path, err)
+	}
+	program, err := goja.Compile(path, string(source), false)
+	if err != nil {
+		return nil, newScriptError(path, err)
+	}
+	mapping, err := rawConfigToMap(raw)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = defaultScriptTimeout
+	}
+	vm, err := newScriptRuntime()
+	if err != nil {
+		return nil, err
+	}
+	stop := watchScript(vm, timeout, scriptMemoryLimit)
+	defer stop()
+	if _, err = vm.RunProgram(program); err != nil {
+		return nil, newScriptError(path, err)
+	}
+	entry, ok := goja.AssertFunction(vm.Get(scriptEntryFunction))
+	if !ok {
+		return nil, newScriptError(path, fmt.Errorf("function %s not found", scriptEntryFunction))
+	}
+	// hand the script a plain js object, a wrapped go map loses array updates
+	data, err := json.Marshal(mapping)
+	if err != nil {
+		return nil, err
+	}
+	parse, _ := goja.AssertFunction(vm.Get("JSON").ToObject(vm).Get("parse"))
+	argument, err := parse(goja.Undefined(), vm.ToValue(string(data)))
+	if err != nil {
+		return nil, newScriptError(path, err)
+	}
+	value, err := entry(goja.Undefined(), argument)
+	if err != nil {
+		return nil, newScriptError(path, err)
+	}
+	result, ok := value.Export().(map[string]any)
+	if !ok {
+		return nil, newScriptError(path, fmt.Errorf("%s must return the config object", scriptEntryFunction))
+	}
+	transformed, err := mapToRawConfig(result)
+	if err != nil {
+		return nil, newScriptError(path, err)
+	}
+	return transformed, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"github.com/metacubex/mihomo/constant"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runTestScript(t *testing.T, source string, timeout time.Duration) (*SetupParams, error) {
+	t.Helper()
+	if err := os.WriteFile(constant.Path.Resolve("script.js"), []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	params := testSetupParams("proxy", "MATCH,proxy")
+	transformed, err := runConfigScript("script.js", params.Config, timeout)
+	params.Config = transformed
+	return params, err
+}
+
+func TestRunConfigScript(t *testing.T) {
+	useTestHomeDir(t)
+	params, err := runTestScript(t, `
+function main(config) {
+	config.rules.unshift("DOMAIN,example.com,DIRECT");
+	config.proxies.push({name: "other", type: "socks5", server: "127.0.0.1", port: 1081});
+	config["mixed-port"] = 7890;
+	return config;
+}`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(params.Config.Rule) != 2 || params.Config.Rule[0] != "DOMAIN,example.com,DIRECT" || len(params.Config.Proxy) != 2 || params.Config.MixedPort != 7890 {
+		t.Fatalf("transformed config %+v", params.Config)
+	}
+}
+
+func TestRunConfigScriptErrors(t *testing.T) {
+	useTestHomeDir(t)
+	for _, test := range []struct {
+		name    string
+		source  string
+		message string
+		line    int
+	}{
+		{"syntax", "function main(config) {\n\treturn config\n", "", 3},
+		{"throw", "function main(config) {\n\tthrow new Error('broken');\n}", "Error: broken", 2},
+		{"no main", "var x = 1;", "function main not found", 0},
+		{"no config", "function main(config) { return 1; }", "main must return the config object", 0},
+		{"timeout", "function main(config) { for (;;) {} }", "timeout after 100ms", 0},
+		{"recursion", "function main(config) { return main(config); }", "", 0},
+		{"no buffers", "function main(config) { new ArrayBuffer(1 << 30); return config; }", "ReferenceError: ArrayBuffer is not defined", 0},
+		{"repeat", "function main(config) { 'x'.repeat(1 << 30); return config; }", "RangeError: memory limit exceeded", 0},
+		{"pad", "function main(config) { 'x'.padEnd(1 << 30, 'y'); return config; }", "RangeError: memory limit exceeded", 0},
+	} {
+		_, err := runTestScript(t, test.source, 100*time.Millisecond)
+		var e *scriptError
+		if !errors.As(err, &e) {
+			t.Errorf("%s: error %v, want a script error", test.name, err)
+			continue
+		}
+		if !strings.Contains(e.diagnostic.Message, test.message) || (test.line != 0 && e.diagnostic.Line != test.line) {
+			t.Errorf("%s: diagnostic %+v", test.name, e.diagnostic)
+		}
+	}
+}
+
+func TestRunConfigScriptMemoryLimit(t *testing.T) {
+	useTestHomeDir(t)
+	start := time.Now()
+	_, err := runTestScript(t, `
+function main(config) {
+	const chunks = [];
+	for (;;) {
+		chunks.push(new Array(1 << 16).fill(chunks.length));
+	}
+}`, time.Minute)
+	var e *scriptError
+	if !errors.As(err, &e) || e.diagnostic.Message != "memory limit exceeded" {
+		t.Fatalf("error %v, want the memory limit", err)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Fatalf("stopped after %v", elapsed)
+	}
+}
@@ -23,7 +23,7 @@ func (result ActionResult) send() {
 func sendMessage(message Message) {
 	result := ActionResult{
 		Method: messageMethod,
-		Data:   message,
+		Data:   defaultRedactor.Message(message),
 	}
 	result.send()
 }
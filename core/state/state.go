@@ -1,10 +1,30 @@
 package state
 
-import "net/netip"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync"
+)
 
 var DefaultIpv4Address = "172.19.0.1/30"
 var DefaultDnsAddress = "172.19.0.2"
 var DefaultIpv6Address = "fdfe:dcba:9876::1/126"
+var DefaultMTU uint32 = 9000
+
+const (
+	AcceptSelectedMode = "acceptSelected"
+	RejectSelectedMode = "rejectSelected"
+)
+
+const (
+	MinMTU = 576
+	MaxMTU = 65535
+)
 
 type AndroidVpnOptions struct {
 	Enable           bool           `json:"enable"`
@@ -17,13 +37,22 @@ type AndroidVpnOptions struct {
 	Ipv4Address      string         `json:"ipv4Address"`
 	Ipv6Address      string         `json:"ipv6Address"`
 	DnsServerAddress string         `json:"dnsServerAddress"`
+	MTU              uint32         `json:"mtu"`
 }
 
 type AccessControl struct {
-	Enable            bool     `json:"enable"`
-	Mode              string   `json:"mode"`
-	AcceptList        []string `json:"acceptList"`
-	RejectList        []string `json:"rejectList"`
+	Enable     bool     `json:"enable"`
+	Mode       string   `json:"mode"`
+	AcceptList []string `json:"acceptList"`
+	RejectList []string `json:"rejectList"`
+	// Proxy forces the apps routed through the tun to a proxy instead of the
+	// rules, only app-access-control supports it.
+	Proxy string `json:"proxy,omitempty"`
+	// Sort, IsFilterSystemApp and IsFilterNonInternetApp only drive the app
+	// list of the app, they are kept for its state to round-trip.
+	Sort                   string `json:"sort,omitempty"`
+	IsFilterSystemApp      bool   `json:"isFilterSystemApp,omitempty"`
+	IsFilterNonInternetApp bool   `json:"isFilterNonInternetApp,omitempty"`
 }
 
 type AndroidVpnRawOptions struct {
@@ -34,26 +63,361 @@ type AndroidVpnRawOptions struct {
 	Ipv6          bool           `json:"ipv6"`
 }
 
+// TunAddress overrides the addressing of the tun device, empty fields fall
+// back to the defaults on android and to the config on desktop, which hijacks
+// dns without DnsAddress. Gateway is the address of the device in
+// Ipv4Address.
+type TunAddress struct {
+	Ipv4Address string `json:"ipv4-address"`
+	Ipv6Address string `json:"ipv6-address"`
+	DnsAddress  string `json:"dns-address"`
+	Gateway     string `json:"gateway"`
+	MTU         uint32 `json:"mtu"`
+}
+
 type State struct {
 	VpnProps            AndroidVpnRawOptions `json:"vpn-props"`
 	CurrentProfileName  string               `json:"current-profile-name"`
 	OnlyStatisticsProxy bool                 `json:"only-statistics-proxy"`
 	BypassDomain        []string             `json:"bypass-domain"`
+	TunAddress          TunAddress           `json:"tun-address"`
+	// AppAccessControl selects the apps routed through the tun on linux, the
+	// entries are uids, process paths or process names.
+	AppAccessControl *AccessControl `json:"app-access-control"`
+}
+
+var (
+	lock    sync.RWMutex
+	current = &State{}
+
+	// updateLock serializes Update and Load, readers only take lock.
+	updateLock sync.Mutex
+	// seq numbers the changes so a hook never overwrites a newer state.
+	seq uint64
+	// pending holds the patches applied before Load, they are replayed on
+	// the loaded state.
+	pending []map[string]any
+	loaded  bool
+
+	hookLock    sync.Mutex
+	notifiedSeq uint64
+
+	// ChangeHook is called with the new state after every change, outside
+	// of the state locks. Calls are serialized and a state older than the
+	// last notified one is skipped.
+	ChangeHook func(state State)
+
+	// ValidateHook checks an updated state against the running config, it is
+	// given the previous state to skip the checks of unchanged fields.
+	ValidateHook func(previous State, next State) error
+)
+
+func cloneStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	return append([]string{}, values...)
+}
+
+func (a *AccessControl) clone() *AccessControl {
+	if a == nil {
+		return nil
+	}
+	accessControl := *a
+	accessControl.AcceptList = cloneStrings(a.AcceptList)
+	accessControl.RejectList = cloneStrings(a.RejectList)
+	return &accessControl
+}
+
+func (a *AccessControl) validate(field string) error {
+	if a == nil || !a.Enable {
+		return nil
+	}
+	switch a.Mode {
+	case AcceptSelectedMode, RejectSelectedMode:
+	default:
+		return fmt.Errorf("%s.mode: unknown mode %s", field, a.Mode)
+	}
+	if strings.ContainsAny(a.Proxy, ",()") {
+		return fmt.Errorf("%s.proxy: invalid name %s", field, a.Proxy)
+	}
+	return nil
+}
+
+func validateNotEmpty(field string, values []string) error {
+	for index, value := range values {
+		if strings.TrimSpace(value) == "" {
+			return fmt.Errorf("%s[%d]: must not be empty", field, index)
+		}
+	}
+	return nil
+}
+
+func (s *State) clone() State {
+	state := *s
+	state.BypassDomain = cloneStrings(s.BypassDomain)
+	state.VpnProps.AccessControl = s.VpnProps.AccessControl.clone()
+	state.AppAccessControl = s.AppAccessControl.clone()
+	return state
+}
+
+func (s *State) Validate() error {
+	if err := s.VpnProps.AccessControl.validate("vpn-props.accessControl"); err != nil {
+		return err
+	}
+	if err := s.AppAccessControl.validate("app-access-control"); err != nil {
+		return err
+	}
+	if accessControl := s.VpnProps.AccessControl; accessControl != nil && accessControl.Proxy != "" {
+		return errors.New("vpn-props.accessControl.proxy: not supported")
+	}
+	if accessControl := s.AppAccessControl; accessControl != nil {
+		if err := validateNotEmpty("app-access-control.acceptList", accessControl.AcceptList); err != nil {
+			return err
+		}
+		if err := validateNotEmpty("app-access-control.rejectList", accessControl.RejectList); err != nil {
+			return err
+		}
+	}
+	if err := validateNotEmpty("bypass-domain", s.BypassDomain); err != nil {
+		return err
+	}
+	return s.TunAddress.validate()
+}
+
+func (t *TunAddress) validate() error {
+	prefix4 := netip.MustParsePrefix(DefaultIpv4Address)
+	if t.Ipv4Address != "" {
+		prefix, err := netip.ParsePrefix(t.Ipv4Address)
+		if err != nil || !prefix.Addr().Is4() {
+			return fmt.Errorf("tun-address.ipv4-address: invalid ipv4 prefix %s", t.Ipv4Address)
+		}
+		prefix4 = prefix
+	}
+	if t.Ipv6Address != "" {
+		prefix, err := netip.ParsePrefix(t.Ipv6Address)
+		if err != nil || !prefix.Addr().Is6() {
+			return fmt.Errorf("tun-address.ipv6-address: invalid ipv6 prefix %s", t.Ipv6Address)
+		}
+	}
+	gateway := prefix4.Addr()
+	if t.Gateway != "" {
+		addr, err := netip.ParseAddr(t.Gateway)
+		if err != nil || !addr.Is4() {
+			return fmt.Errorf("tun-address.gateway: invalid ipv4 address %s", t.Gateway)
+		}
+		if !prefix4.Contains(addr) {
+			return fmt.Errorf("tun-address.gateway: %s is not in %s", t.Gateway, prefix4)
+		}
+		gateway = addr
+	}
+	if t.DnsAddress != "" {
+		addr, err := netip.ParseAddr(t.DnsAddress)
+		if err != nil {
+			return fmt.Errorf("tun-address.dns-address: invalid address %s", t.DnsAddress)
+		}
+		if addr == gateway {
+			return fmt.Errorf("tun-address.dns-address: must differ from the gateway %s", gateway)
+		}
+	}
+	if t.MTU != 0 && (t.MTU < MinMTU || t.MTU > MaxMTU) {
+		return fmt.Errorf("tun-address.mtu: must be between %d and %d", MinMTU, MaxMTU)
+	}
+	return nil
 }
 
-var CurrentState = &State{
-	OnlyStatisticsProxy: false,
-	CurrentProfileName:  "",
+// Ipv4Address returns the ipv4 prefix of the tun device with the gateway as
+// its address.
+func (s *State) Ipv4Address() string {
+	address := DefaultIpv4Address
+	if s.TunAddress.Ipv4Address != "" {
+		address = s.TunAddress.Ipv4Address
+	}
+	prefix, err := netip.ParsePrefix(address)
+	if err != nil {
+		return DefaultIpv4Address
+	}
+	if gateway, err := netip.ParseAddr(s.TunAddress.Gateway); err == nil {
+		prefix = netip.PrefixFrom(gateway, prefix.Bits())
+	}
+	return prefix.String()
 }
 
-func GetIpv6Address() string {
-	if CurrentState.VpnProps.Ipv6 {
-		return DefaultIpv6Address
-	} else {
+// Ipv6Address returns the ipv6 prefix of the tun device, empty when ipv6 is
+// disabled.
+func (s *State) Ipv6Address() string {
+	if !s.VpnProps.Ipv6 {
 		return ""
 	}
+	if s.TunAddress.Ipv6Address != "" {
+		return s.TunAddress.Ipv6Address
+	}
+	return DefaultIpv6Address
 }
 
-func GetDnsServerAddress() string {
+func (s *State) DnsAddress() string {
+	if s.TunAddress.DnsAddress != "" {
+		return s.TunAddress.DnsAddress
+	}
 	return DefaultDnsAddress
 }
+
+func (s *State) MTU() uint32 {
+	if s.TunAddress.MTU != 0 {
+		return s.TunAddress.MTU
+	}
+	return DefaultMTU
+}
+
+// TunPrefixes returns the prefixes assigned to the tun device.
+func (s *State) TunPrefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, address := range []string{s.Ipv4Address(), s.Ipv6Address()} {
+		if prefix, err := netip.ParsePrefix(address); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// mergePatch applies a json merge patch, objects are merged, null removes
+// the key and any other value replaces it.
+func mergePatch(target map[string]any, patch map[string]any) {
+	for key, value := range patch {
+		if value == nil {
+			delete(target, key)
+			continue
+		}
+		patchMap, ok := value.(map[string]any)
+		if !ok {
+			target[key] = value
+			continue
+		}
+		targetMap, ok := target[key].(map[string]any)
+		if !ok {
+			targetMap = map[string]any{}
+		}
+		mergePatch(targetMap, patchMap)
+		target[key] = targetMap
+	}
+}
+
+// Get returns a copy of the current state.
+func Get() State {
+	lock.RLock()
+	defer lock.RUnlock()
+	return current.clone()
+}
+
+// patchState returns base with patch merged in, unknown keys are rejected.
+func patchState(base *State, patch map[string]any) (*State, error) {
+	data, err := json.Marshal(base)
+	if err != nil {
+		return nil, err
+	}
+	var stateMap map[string]any
+	if err = json.Unmarshal(data, &stateMap); err != nil {
+		return nil, err
+	}
+	mergePatch(stateMap, patch)
+	if data, err = json.Marshal(stateMap); err != nil {
+		return nil, err
+	}
+	next := &State{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(next); err != nil {
+		return nil, err
+	}
+	if err = next.Validate(); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// notify calls ChangeHook with the state of change unless a newer one was
+// notified already.
+func notify(state State, change uint64) {
+	if ChangeHook == nil {
+		return
+	}
+	hookLock.Lock()
+	defer hookLock.Unlock()
+	if change <= notifiedSeq {
+		return
+	}
+	notifiedSeq = change
+	ChangeHook(state)
+}
+
+// Update applies patch as a json merge patch to the state, the state is
+// replaced only when the patched state is valid.
+func Update(patch []byte) (State, error) {
+	var patchMap map[string]any
+	if err := json.Unmarshal(patch, &patchMap); err != nil {
+		return Get(), err
+	}
+	if patchMap == nil {
+		return Get(), errors.New("state patch must be an object")
+	}
+	updateLock.Lock()
+	previous := Get()
+	next, err := patchState(&previous, patchMap)
+	if err != nil {
+		updateLock.Unlock()
+		return previous, err
+	}
+	if ValidateHook != nil {
+		if err = ValidateHook(previous, next.clone()); err != nil {
+			updateLock.Unlock()
+			return previous, err
+		}
+	}
+	if !loaded {
+		pending = append(pending, patchMap)
+	}
+	if reflect.DeepEqual(next, &previous) {
+		updateLock.Unlock()
+		return previous, nil
+	}
+	lock.Lock()
+	current = next
+	seq++
+	change := seq
+	lock.Unlock()
+	updateLock.Unlock()
+	notify(next.clone(), change)
+	return next.clone(), nil
+}
+
+// Load replaces the state with a persisted one, empty data when there is
+// none, and replays the patches applied before on it. It reports whether
+// they changed the persisted state, ChangeHook is not called. An invalid
+// persisted state is replaced by the default one.
+func Load(data []byte) (bool, error) {
+	updateLock.Lock()
+	defer updateLock.Unlock()
+	base := &State{}
+	var err error
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, base); err == nil {
+			err = base.Validate()
+		}
+		if err != nil {
+			base = &State{}
+		}
+	}
+	next := base
+	for _, patch := range pending {
+		if patched, patchErr := patchState(next, patch); patchErr == nil {
+			next = patched
+		}
+	}
+	pending = nil
+	loaded = true
+	lock.Lock()
+	current = next
+	seq++
+	lock.Unlock()
+	return !reflect.DeepEqual(next, base), err
+}
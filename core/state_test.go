@@ -0,0 +1,59 @@
+package main
+
+import (
+	"core/state"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// appStatePayload is a setState payload as the app sends it.
+const appStatePayload = `{
+  "vpn-props": {
+    "enable": true,
+    "systemProxy": true,
+    "ipv6": false,
+    "allowBypass": true,
+    "accessControl": {
+      "enable": true,
+      "mode": "rejectSelected",
+      "acceptList": [],
+      "rejectList": ["com.example.app"],
+      "sort": "none",
+      "isFilterSystemApp": true,
+      "isFilterNonInternetApp": true
+    }
+  },
+  "only-statistics-proxy": false,
+  "current-profile-name": "profile",
+  "bypass-domain": ["localhost"]
+}`
+
+func TestUpdateStateAppPayload(t *testing.T) {
+	t.Cleanup(func() {
+		_ = updateState(`{"vpn-props":null,"current-profile-name":null,"bypass-domain":null}`)
+	})
+	if err := updateState(appStatePayload); err != nil {
+		t.Fatal(err)
+	}
+	current := state.Get()
+	accessControl := current.VpnProps.AccessControl
+	if !current.VpnProps.Enable || current.CurrentProfileName != "profile" || accessControl == nil {
+		t.Fatalf("state = %+v", current)
+	}
+	if accessControl.Mode != state.RejectSelectedMode || len(accessControl.RejectList) != 1 ||
+		accessControl.Sort != "none" || !accessControl.IsFilterSystemApp || !accessControl.IsFilterNonInternetApp {
+		t.Fatalf("access control = %+v", accessControl)
+	}
+	data, err := json.Marshal(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"isFilterNonInternetApp":true`) {
+		t.Errorf("state does not round-trip: %s", data)
+	}
+
+	if err = updateState(`{"vpn-props":{"unknown":true}}`); err == nil {
+		t.Error("an unknown field passed")
+	}
+}
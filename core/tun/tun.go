@@ -24,17 +24,18 @@ type Props struct {
 	Dns6     string `json:"dns6"`
 }
 
-func Start(fd int, device string, stack constant.TUNStack) (*sing_tun.Listener, error) {
+func Start(fd int, device string, stack constant.TUNStack, mtu uint32) (*sing_tun.Listener, error) {
+	current := state.Get()
 	var prefix4 []netip.Prefix
-	tempPrefix4, err := netip.ParsePrefix(state.DefaultIpv4Address)
+	tempPrefix4, err := netip.ParsePrefix(current.Ipv4Address())
 	if err != nil {
 		log.Errorln("startTUN error:", err)
 		return nil, err
 	}
 	prefix4 = append(prefix4, tempPrefix4)
 	var prefix6 []netip.Prefix
-	if state.CurrentState.VpnProps.Ipv6 {
-		tempPrefix6, err := netip.ParsePrefix(state.DefaultIpv6Address)
+	if current.VpnProps.Ipv6 {
+		tempPrefix6, err := netip.ParsePrefix(current.Ipv6Address())
 		if err != nil {
 			log.Errorln("startTUN error:", err)
 			return nil, err
@@ -43,7 +44,7 @@ func Start(fd int, device string, stack constant.TUNStack) (*sing_tun.Listener,
 	}
 
 	var dnsHijack []string
-	dnsHijack = append(dnsHijack, net.JoinHostPort(state.GetDnsServerAddress(), "53"))
+	dnsHijack = append(dnsHijack, net.JoinHostPort(current.DnsAddress(), "53"))
 
 	options := LC.Tun{
 		Enable:              true,
@@ -54,7 +55,7 @@ func Start(fd int, device string, stack constant.TUNStack) (*sing_tun.Listener,
 		AutoDetectInterface: false,
 		Inet4Address:        prefix4,
 		Inet6Address:        prefix6,
-		MTU:                 9000,
+		MTU:                 mtu,
 		FileDescriptor:      fd,
 	}
 
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"core/state"
+	"errors"
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/constant/features"
+	"github.com/metacubex/mihomo/listener"
+	LC "github.com/metacubex/mihomo/listener/config"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// payload mihomo logs when ReCreateTun fails
+	tunStartErrorPrefix = "Start TUN listening error: "
+	// how long a failed start waits for its logged error
+	tunStartErrorTimeout = time.Second
+)
+
+var errTunNotStarted = errors.New("tun device not started")
+
+type TunStatus struct {
+	Enable              bool       `json:"enable"`
+	Running             bool       `json:"running"`
+	Device              string     `json:"device"`
+	Stack               string     `json:"stack"`
+	MTU                 uint32     `json:"mtu"`
+	Inet4Address        []string   `json:"inet4-address"`
+	Inet6Address        []string   `json:"inet6-address"`
+	AutoRoute           bool       `json:"auto-route"`
+	Routes              []string   `json:"routes"`
+	RouteExcludeAddress []string   `json:"route-exclude-address"`
+	DNSHijack           []string   `json:"dns-hijack"`
+	Error               string     `json:"error,omitempty"`
+	StartedAt           *time.Time `json:"started-at,omitempty"`
+}
+
+// tunStatusStore tracks the desktop tun listener of mihomo, which reports
+// failures only through the log, and sends a message on every change.
+type tunStatusStore struct {
+	sync.Mutex
+	status *TunStatus
+}
+
+var tunStatus = &tunStatusStore{
+	status: newTunStatus(LC.Tun{}, false),
+}
+
+func prefixStrings(prefixes ...[]netip.Prefix) []string {
+	result := []string{}
+	for _, items := range prefixes {
+		for _, prefix := range items {
+			result = append(result, prefix.String())
+		}
+	}
+	return result
+}
+
+// tunRoutes returns the routes auto-route installs, all traffic of the
+// families of the device when no route-address is set.
+func tunRoutes(conf LC.Tun) []string {
+	if !conf.AutoRoute {
+		return []string{}
+	}
+	routes := prefixStrings(conf.RouteAddress, conf.Inet4RouteAddress, conf.Inet6RouteAddress)
+	if len(routes) > 0 {
+		return routes
+	}
+	if len(conf.Inet4Address) > 0 {
+		routes = append(routes, "0.0.0.0/0")
+	}
+	if len(conf.Inet6Address) > 0 {
+		routes = append(routes, "::/0")
+	}
+	return routes
+}
+
+func newTunStatus(conf LC.Tun, enable bool) *TunStatus {
+	status := &TunStatus{
+		Enable:              enable,
+		Running:             conf.Enable,
+		Device:              conf.Device,
+		Stack:               conf.Stack.String(),
+		MTU:                 conf.MTU,
+		Inet4Address:        prefixStrings(conf.Inet4Address),
+		Inet6Address:        prefixStrings(conf.Inet6Address),
+		AutoRoute:           conf.AutoRoute,
+		Routes:              tunRoutes(conf),
+		RouteExcludeAddress: prefixStrings(conf.RouteExcludeAddress, conf.Inet4RouteExcludeAddress, conf.Inet6RouteExcludeAddress),
+		DNSHijack:           append([]string{}, conf.DNSHijack...),
+	}
+	if status.Running && status.MTU == 0 {
+		status.MTU = state.DefaultMTU
+	}
+	if status.DNSHijack == nil {
+		status.DNSHijack = []string{}
+	}
+	return status
+}
+
+func (s *tunStatusStore) send(status *TunStatus) {
+	data := *status
+	sendMessage(Message{
+		Type: TunStatusMessage,
+		Data: &data,
+	})
+}
+
+// Refresh reads the running tun listener after it was recreated, enable is
+// whether the config asked for it and err the error of a failed start.
+func (s *tunStatusStore) Refresh(enable bool, err error) {
+	status := newTunStatus(listener.GetTunConf(), enable)
+	s.Lock()
+	last := s.status
+	switch {
+	case status.Running && last.Running:
+		status.StartedAt = last.StartedAt
+	case status.Running:
+		now := time.Now()
+		status.StartedAt = &now
+	case err != nil:
+		status.Error = err.Error()
+	case enable:
+		// keep the logged error of the failed start
+		status.Error = last.Error
+		if status.Error == "" {
+			status.Error = errTunNotStarted.Error()
+		}
+	}
+	if reflect.DeepEqual(status, last) {
+		s.Unlock()
+		return
+	}
+	s.status = status
+	s.Unlock()
+	s.send(status)
+}
+
+// Observe picks the start error of the tun listener from a log payload.
+func (s *tunStatusStore) Observe(payload string) {
+	message, ok := strings.CutPrefix(payload, tunStartErrorPrefix)
+	if !ok {
+		return
+	}
+	s.Lock()
+	if s.status.Running || s.status.Error == message {
+		s.Unlock()
+		return
+	}
+	status := *s.status
+	status.Error = message
+	s.status = &status
+	s.Unlock()
+	s.send(&status)
+}
+
+func (s *tunStatusStore) Status() *TunStatus {
+	s.Lock()
+	defer s.Unlock()
+	status := *s.status
+	return &status
+}
+
+// recreateTun recreates the desktop tun listener from tun and returns the
+// error of a failed start, which mihomo only logs.
+func recreateTun(tun LC.Tun) error {
+	sub := log.Subscribe()
+	errCh := make(chan string, 1)
+	go func() {
+		for event := range sub {
+			if message, ok := strings.CutPrefix(event.Payload, tunStartErrorPrefix); ok {
+				select {
+				case errCh <- message:
+				default:
+				}
+			}
+		}
+	}()
+	defer log.UnSubscribe(sub)
+	listener.ReCreateTun(tun, tunnel.Tunnel)
+	if !tun.Enable || listener.GetTunConf().Enable {
+		return nil
+	}
+	select {
+	case message := <-errCh:
+		return errors.New(message)
+	case <-time.After(tunStartErrorTimeout):
+		return errTunNotStarted
+	}
+}
+
+// updateTun recreates the desktop tun listener from the current config and
+// the tun addressing of the state, the lock must be held.
+func updateTun() {
+	tun := withTunAddress(currentConfig.General.Tun, state.Get())
+	tunStatus.Refresh(tun.Enable, recreateTun(tun))
+}
+
+// setTunEnable starts or stops the tun device alone, the other listeners are
+// left as they are. The change is kept for later reloads only when it
+// succeeded.
+func setTunEnable(enable bool) error {
+	if features.Android {
+		return errors.New("tun is managed by the vpn service on android")
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	if currentConfig == nil {
+		return errors.New("config not loaded")
+	}
+	if enable && !isRunning {
+		return errors.New("listener not running")
+	}
+	tun := withTunAddress(currentConfig.General.Tun, state.Get())
+	tun.Enable = enable
+	err := recreateTun(tun)
+	if err == nil {
+		currentConfig.General.Tun.Enable = enable
+		patchLastGoodConfig(func(raw *config.RawConfig) {
+			raw.Tun.Enable = enable
+		})
+	}
+	tunStatus.Refresh(currentConfig.General.Tun.Enable, err)
+	return err
+}
@@ -0,0 +1,129 @@
+//go:build linux
+
+package main
+
+import (
+	"github.com/metacubex/mihomo/config"
+	C "github.com/metacubex/mihomo/constant"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+const netnsTestEnv = "CORE_TEST_NETNS"
+
+// inNetns runs the test again in a new network namespace, it returns true in
+// the child, which does the checks, and false in the parent.
+func inNetns(t *testing.T) bool {
+	t.Helper()
+	if os.Getenv(netnsTestEnv) == t.Name() {
+		return true
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("network namespaces need root")
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skip("tun device not available")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), netnsTestEnv+"="+t.Name())
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNET,
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if !strings.Contains(string(output), "--- PASS: "+t.Name()) {
+		t.Skipf("skipped in the namespace\n%s", output)
+	}
+	return false
+}
+
+// setupTunTest loads a config with a disabled tun named device.
+func setupTunTest(t *testing.T, device string) {
+	t.Helper()
+	params := defaultSetupParams()
+	params.Config.Tun.Device = device
+	params.Config.Tun.Stack = C.TunSystem
+	params.Config.Tun.AutoRoute = false
+	params.Config.Tun.AutoDetectInterface = false
+	cfg, err := config.ParseRawConfig(params.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentConfig = cfg
+	lastGoodSetupParams = params
+	isRunning = true
+	t.Cleanup(func() {
+		_ = setTunEnable(false)
+		currentConfig = nil
+		lastGoodSetupParams = nil
+		isRunning = false
+	})
+}
+
+func TestSetTunEnable(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+	setupTunTest(t, "coretest0")
+	if err := setTunEnable(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.InterfaceByName("coretest0"); err != nil {
+		t.Fatal(err)
+	}
+	status := tunStatus.Status()
+	if !status.Enable || !status.Running || status.Device != "coretest0" || status.StartedAt == nil || status.Error != "" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if !lastGoodSetupParams.Config.Tun.Enable {
+		t.Fatal("start not kept for reloads")
+	}
+	if err := setTunEnable(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.InterfaceByName("coretest0"); err == nil {
+		t.Fatal("device left after stop")
+	}
+	if status = tunStatus.Status(); status.Enable || status.Running {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if lastGoodSetupParams.Config.Tun.Enable || currentConfig.General.Tun.Enable {
+		t.Fatal("stop not kept for reloads")
+	}
+}
+
+func TestSetTunEnableError(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+	// linux limits interface names to 15 bytes
+	setupTunTest(t, "coretest-name-too-long")
+	err := setTunEnable(true)
+	if err == nil {
+		t.Fatal("expected the start error")
+	}
+	if err == errTunNotStarted {
+		t.Fatal("start error not picked from the log")
+	}
+	status := tunStatus.Status()
+	if status.Running || status.Error != err.Error() {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if currentConfig.General.Tun.Enable || lastGoodSetupParams.Config.Tun.Enable {
+		t.Fatal("failed start kept in the config")
+	}
+}
+
+func TestSetTunEnableNotRunning(t *testing.T) {
+	setupTunTest(t, "coretest0")
+	isRunning = false
+	if err := setTunEnable(true); err == nil {
+		t.Fatal("expected an error while the listeners are stopped")
+	}
+}
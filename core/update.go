@@ -0,0 +1,396 @@
+package main
+
+import (
+	"core/state"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/component/auth"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/constant/features"
+	"github.com/metacubex/mihomo/listener"
+	authStore "github.com/metacubex/mihomo/listener/auth"
+	LC "github.com/metacubex/mihomo/listener/config"
+	"net"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+type UpdateFieldResult struct {
+	Field   string `json:"field"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+type dnsSchema struct {
+	Enable                *bool             `json:"enable"`
+	IPv6                  *bool             `json:"ipv6"`
+	UseHosts              *bool             `json:"use-hosts"`
+	Listen                *string           `json:"listen"`
+	EnhancedMode          *constant.DNSMode `json:"enhanced-mode"`
+	NameServer            *[]string         `json:"nameserver"`
+	Fallback              *[]string         `json:"fallback"`
+	DefaultNameserver     *[]string         `json:"default-nameserver"`
+	ProxyServerNameserver *[]string         `json:"proxy-server-nameserver"`
+	DirectNameServer      *[]string         `json:"direct-nameserver"`
+	FakeIPRange           *string           `json:"fake-ip-range"`
+	FakeIPFilter          *[]string         `json:"fake-ip-filter"`
+}
+
+type snifferSchema struct {
+	Enable          *bool     `json:"enable"`
+	OverrideDest    *bool     `json:"override-destination"`
+	ForceDnsMapping *bool     `json:"force-dns-mapping"`
+	ParsePureIp     *bool     `json:"parse-pure-ip"`
+	ForceDomain     *[]string `json:"force-domain"`
+	SkipDomain      *[]string `json:"skip-domain"`
+	SkipSrcAddress  *[]string `json:"skip-src-address"`
+	SkipDstAddress  *[]string `json:"skip-dst-address"`
+}
+
+func (s *dnsSchema) patch(raw *config.RawDNS) {
+	if s.Enable != nil {
+		raw.Enable = *s.Enable
+	}
+	if s.IPv6 != nil {
+		raw.IPv6 = *s.IPv6
+	}
+	if s.UseHosts != nil {
+		raw.UseHosts = *s.UseHosts
+	}
+	if s.Listen != nil {
+		raw.Listen = *s.Listen
+	}
+	if s.EnhancedMode != nil {
+		raw.EnhancedMode = *s.EnhancedMode
+	}
+	if s.NameServer != nil {
+		raw.NameServer = *s.NameServer
+	}
+	if s.Fallback != nil {
+		raw.Fallback = *s.Fallback
+	}
+	if s.DefaultNameserver != nil {
+		raw.DefaultNameserver = *s.DefaultNameserver
+	}
+	if s.ProxyServerNameserver != nil {
+		raw.ProxyServerNameserver = *s.ProxyServerNameserver
+	}
+	if s.DirectNameServer != nil {
+		raw.DirectNameServer = *s.DirectNameServer
+	}
+	if s.FakeIPRange != nil {
+		raw.FakeIPRange = *s.FakeIPRange
+	}
+	if s.FakeIPFilter != nil {
+		raw.FakeIPFilter = *s.FakeIPFilter
+	}
+}
+
+func (s *snifferSchema) patch(raw *config.RawSniffer) {
+	if s.Enable != nil {
+		raw.Enable = *s.Enable
+	}
+	if s.OverrideDest != nil {
+		raw.OverrideDest = *s.OverrideDest
+	}
+	if s.ForceDnsMapping != nil {
+		raw.ForceDnsMapping = *s.ForceDnsMapping
+	}
+	if s.ParsePureIp != nil {
+		raw.ParsePureIp = *s.ParsePureIp
+	}
+	if s.ForceDomain != nil {
+		raw.ForceDomain = *s.ForceDomain
+	}
+	if s.SkipDomain != nil {
+		raw.SkipDomain = *s.SkipDomain
+	}
+	if s.SkipSrcAddress != nil {
+		raw.SkipSrcAddress = *s.SkipSrcAddress
+	}
+	if s.SkipDstAddress != nil {
+		raw.SkipDstAddress = *s.SkipDstAddress
+	}
+}
+
+// sectionRawConfig returns a default raw config with the settings the
+// sections are parsed with copied from raw, keep copies the sections
+// themselves. Parsing it skips the proxies, rules and listeners of raw.
+func sectionRawConfig(raw *config.RawConfig, keep func(section *config.RawConfig)) *config.RawConfig {
+	section := config.DefaultRawConfig()
+	section.IPv6 = raw.IPv6
+	section.GeodataMode = raw.GeodataMode
+	section.GeodataLoader = raw.GeodataLoader
+	section.GeositeMatcher = raw.GeositeMatcher
+	section.GeoXUrl = raw.GeoXUrl
+	section.Profile = raw.Profile
+	section.RuleProvider = raw.RuleProvider
+	keep(section)
+	return section
+}
+
+// patchRawConfig parses the sections keep copies from raw with patch applied
+// and hands the result to apply, raw is only patched when that succeeds.
+func patchRawConfig(raw *config.RawConfig, patch func(raw *config.RawConfig), keep func(section *config.RawConfig, raw *config.RawConfig), apply func(cfg *config.Config)) error {
+	patched := *raw
+	patch(&patched)
+	cfg, err := config.ParseRawConfig(sectionRawConfig(&patched, func(section *config.RawConfig) {
+		keep(section, &patched)
+	}))
+	if err != nil {
+		return err
+	}
+	apply(cfg)
+	*raw = patched
+	return nil
+}
+
+// updateConfigSections applies the parts of params that need their section
+// to be parsed again onto raw, runLock must be held by the caller.
+func updateConfigSections(params *UpdateParams, raw *config.RawConfig, record func(field string, err error)) {
+	keepDNS := func(section *config.RawConfig, raw *config.RawConfig) {
+		section.DNS = raw.DNS
+		section.Hosts = raw.Hosts
+	}
+	if params.DNS != nil {
+		record("dns", patchRawConfig(raw, func(raw *config.RawConfig) {
+			params.DNS.patch(&raw.DNS)
+		}, keepDNS, func(cfg *config.Config) {
+			currentConfig.DNS = cfg.DNS
+			reloadDNS(cfg.DNS, currentConfig.General.IPv6)
+		}))
+	}
+	if params.Hosts != nil {
+		record("hosts", patchRawConfig(raw, func(raw *config.RawConfig) {
+			raw.Hosts = *params.Hosts
+		}, keepDNS, func(cfg *config.Config) {
+			currentConfig.Hosts = cfg.Hosts
+			currentConfig.DNS = cfg.DNS
+			resolver.DefaultHosts = resolver.NewHosts(cfg.Hosts)
+			reloadDNS(cfg.DNS, currentConfig.General.IPv6)
+		}))
+	}
+	if params.Sniffer != nil {
+		record("sniffer", patchRawConfig(raw, func(raw *config.RawConfig) {
+			params.Sniffer.patch(&raw.Sniffer)
+		}, func(section *config.RawConfig, raw *config.RawConfig) {
+			section.Sniffer = raw.Sniffer
+		}, func(cfg *config.Config) {
+			currentConfig.Sniffer = cfg.Sniffer
+			reloadSniffer(cfg.Sniffer)
+		}))
+	}
+	if params.Authentication != nil {
+		record("authentication", patchRawConfig(raw, func(raw *config.RawConfig) {
+			raw.Authentication = *params.Authentication
+		}, func(section *config.RawConfig, raw *config.RawConfig) {
+			section.Authentication = raw.Authentication
+		}, func(cfg *config.Config) {
+			currentConfig.Users = cfg.Users
+			authStore.Default.SetAuthenticator(auth.NewAuthenticator(cfg.Users))
+		}))
+	}
+}
+
+// patchGeneral writes the general fields of params into raw, tun only when
+// it passed validation.
+func patchGeneral(params *UpdateParams, raw *config.RawConfig, tunApplied bool) {
+	if params.MixedPort != nil {
+		raw.MixedPort = *params.MixedPort
+	}
+	if params.Port != nil {
+		raw.Port = *params.Port
+	}
+	if params.SocksPort != nil {
+		raw.SocksPort = *params.SocksPort
+	}
+	if params.RedirPort != nil {
+		raw.RedirPort = *params.RedirPort
+	}
+	if params.TProxyPort != nil {
+		raw.TProxyPort = *params.TProxyPort
+	}
+	if params.AllowLan != nil {
+		raw.AllowLan = *params.AllowLan
+	}
+	if params.Sniffing != nil {
+		raw.Sniffer.Enable = *params.Sniffing
+	}
+	if params.FindProcessMode != nil {
+		raw.FindProcessMode = *params.FindProcessMode
+	}
+	if params.TCPConcurrent != nil {
+		raw.TCPConcurrent = *params.TCPConcurrent
+	}
+	if params.Interface != nil {
+		raw.Interface = *params.Interface
+	}
+	if params.UnifiedDelay != nil {
+		raw.UnifiedDelay = *params.UnifiedDelay
+	}
+	if params.Mode != nil {
+		raw.Mode = *params.Mode
+	}
+	if params.LogLevel != nil {
+		raw.LogLevel = *params.LogLevel
+	}
+	if params.IPv6 != nil {
+		raw.IPv6 = *params.IPv6
+	}
+	if params.ExternalController != nil {
+		raw.ExternalController = *params.ExternalController
+	}
+	if params.Tun != nil && tunApplied {
+		params.Tun.patch(&raw.Tun)
+	}
+}
+
+// checkPortFields reports the requested ports that failed to bind.
+func checkPortFields(params *UpdateParams, record func(field string, err error)) {
+	ports := listener.GetPorts()
+	check := func(field string, expected *int, actual int) {
+		if expected == nil {
+			return
+		}
+		if *expected != 0 && actual == 0 && isRunning {
+			record(field, fmt.Errorf("%s %d bind failed", field, *expected))
+			return
+		}
+		record(field, nil)
+	}
+	check("port", params.Port, ports.Port)
+	check("socks-port", params.SocksPort, ports.SocksPort)
+	check("redir-port", params.RedirPort, ports.RedirPort)
+	check("tproxy-port", params.TProxyPort, ports.TProxyPort)
+	check("mixed-port", params.MixedPort, ports.MixedPort)
+}
+
+// patch writes the set fields of s into tun, a *LC.Tun or a *config.RawTun,
+// which name the fields alike.
+func (s *tunSchema) patch(tun any) {
+	source := reflect.ValueOf(s).Elem()
+	target := reflect.ValueOf(tun).Elem()
+	for i := 0; i < source.NumField(); i++ {
+		if value := source.Field(i); !value.IsNil() {
+			target.FieldByName(source.Type().Field(i).Name).Set(value.Elem())
+		}
+	}
+}
+
+func validateUIDRanges(field string, uidRanges []string) error {
+	for _, uidRange := range uidRanges {
+		start, end, ok := strings.Cut(uidRange, ":")
+		if !ok {
+			return fmt.Errorf("%s: missing ':' in range %s", field, uidRange)
+		}
+		from, err := strconv.ParseUint(start, 0, 32)
+		if err != nil {
+			return fmt.Errorf("%s: invalid range start %s", field, uidRange)
+		}
+		to, err := strconv.ParseUint(end, 0, 32)
+		if err != nil {
+			return fmt.Errorf("%s: invalid range end %s", field, uidRange)
+		}
+		if from > to {
+			return fmt.Errorf("%s: range start is greater than end %s", field, uidRange)
+		}
+	}
+	return nil
+}
+
+func validateTun(tun *LC.Tun) error {
+	if tun.MTU != 0 && (tun.MTU < state.MinMTU || tun.MTU > state.MaxMTU) {
+		return fmt.Errorf("mtu: must be between %d and %d", state.MinMTU, state.MaxMTU)
+	}
+	for _, hijack := range tun.DNSHijack {
+		address := hijack
+		if _, rest, ok := strings.Cut(hijack, "://"); ok {
+			address = rest
+		}
+		if _, port, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("dns-hijack: invalid address %s", hijack)
+		} else if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+			return fmt.Errorf("dns-hijack: invalid port %s", hijack)
+		}
+	}
+	for _, prefix := range tun.RouteAddress {
+		if !prefix.IsValid() {
+			return errors.New("route-address: invalid prefix")
+		}
+	}
+	for _, prefix := range tun.RouteExcludeAddress {
+		if !prefix.IsValid() {
+			return errors.New("route-exclude-address: invalid prefix")
+		}
+	}
+	if err := validateUIDRanges("include-uid-range", tun.IncludeUIDRange); err != nil {
+		return err
+	}
+	if err := validateUIDRanges("exclude-uid-range", tun.ExcludeUIDRange); err != nil {
+		return err
+	}
+	return validateTunAddress(state.Get(), tun)
+}
+
+// withTunAddress returns tun with the addressing of the state, the prefixes
+// of the config are kept when the state sets none. Android assigns the
+// addresses of the state to its vpn service instead.
+func withTunAddress(tun LC.Tun, current state.State) LC.Tun {
+	address := current.TunAddress
+	if address.Ipv4Address != "" || address.Gateway != "" {
+		if prefix, err := netip.ParsePrefix(current.Ipv4Address()); err == nil {
+			tun.Inet4Address = []netip.Prefix{prefix}
+		}
+	}
+	// the config drops the ipv6 prefixes when ipv6 is disabled
+	if address.Ipv6Address != "" && len(tun.Inet6Address) > 0 {
+		if prefix, err := netip.ParsePrefix(address.Ipv6Address); err == nil {
+			tun.Inet6Address = []netip.Prefix{prefix}
+		}
+	}
+	if tun.MTU == 0 {
+		tun.MTU = address.MTU
+	}
+	return tun
+}
+
+// validateTunAddress checks the tun addressing of the state against the
+// routes of tun.
+func validateTunAddress(current state.State, tun *LC.Tun) error {
+	prefixes := current.TunPrefixes()
+	if !features.Android {
+		addressed := withTunAddress(*tun, current)
+		prefixes = append(append([]netip.Prefix{}, addressed.Inet4Address...), addressed.Inet6Address...)
+	}
+	for _, prefix := range prefixes {
+		for _, exclude := range tun.RouteExcludeAddress {
+			if exclude.Overlaps(prefix) {
+				return fmt.Errorf("tun address %s conflicts with route-exclude-address %s", prefix, exclude)
+			}
+		}
+		for _, route := range tun.RouteAddress {
+			if route.Bits() > prefix.Bits() && prefix.Overlaps(route) {
+				return fmt.Errorf("tun address %s conflicts with route-address %s", prefix, route)
+			}
+		}
+	}
+	// desktop tuns hijack dns by dns-hijack, only android uses the address
+	if !features.Android {
+		return nil
+	}
+	dnsAddress, err := netip.ParseAddr(current.DnsAddress())
+	if err != nil || len(tun.RouteAddress) == 0 {
+		return nil
+	}
+	// the dns address has to be routed into the tun to be hijacked
+	for _, prefix := range append(prefixes, tun.RouteAddress...) {
+		if prefix.Contains(dnsAddress) {
+			return nil
+		}
+	}
+	return fmt.Errorf("tun dns address %s is not routed into the tun", dnsAddress)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"core/state"
+	"encoding/json"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/config"
+	LC "github.com/metacubex/mihomo/listener/config"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func decodeUpdateParams(t *testing.T, data string) *UpdateParams {
+	t.Helper()
+	params := &UpdateParams{}
+	if err := json.Unmarshal([]byte(data), params); err != nil {
+		t.Fatal(err)
+	}
+	return params
+}
+
+func updateResults(results []*UpdateFieldResult) map[string]*UpdateFieldResult {
+	fields := map[string]*UpdateFieldResult{}
+	for _, result := range results {
+		fields[result.Field] = result
+	}
+	return fields
+}
+
+func setupUpdateTest(t *testing.T) {
+	t.Helper()
+	resetSetupTest(t)
+	if result := setupConfig(testSetupParams("proxy", "MATCH,proxy")); !result.Applied {
+		t.Fatalf("setup = %+v", result)
+	}
+}
+
+func TestUpdateConfigSections(t *testing.T) {
+	setupUpdateTest(t)
+	results := updateResults(updateConfig(decodeUpdateParams(t, `{
+		"dns": {"enable": true, "nameserver": ["udp://192.0.2.53"]},
+		"hosts": {"router.test": "192.0.2.1"},
+		"sniffer": {"enable": true, "force-domain": ["+.example.com"]},
+		"authentication": ["user:pass"],
+		"mode": "global",
+		"tproxy-port": 0
+	}`)))
+	for _, field := range []string{"dns", "hosts", "sniffer", "authentication", "mode", "tproxy-port"} {
+		if result, ok := results[field]; !ok || !result.Success {
+			t.Errorf("%s: %+v", field, result)
+		}
+	}
+	if !currentConfig.DNS.Enable || len(currentConfig.DNS.NameServer) != 1 || len(currentConfig.Users) != 1 {
+		t.Fatalf("running config %+v", currentConfig)
+	}
+	if node, ok := resolver.DefaultHosts.Search("router.test", false); !ok || len(node.IPs) != 1 {
+		t.Fatal("hosts not applied to the resolver")
+	}
+	raw := lastGoodSetupParams.Config
+	if !raw.DNS.Enable || raw.DNS.NameServer[0] != "udp://192.0.2.53" || raw.Hosts["router.test"] != "192.0.2.1" ||
+		!raw.Sniffer.Enable || len(raw.Authentication) != 1 || raw.Mode.String() != "global" {
+		t.Fatalf("applied fields not kept for reloads: %+v", raw)
+	}
+}
+
+func TestUpdateConfigInvalidSection(t *testing.T) {
+	setupUpdateTest(t)
+	dns := currentConfig.DNS
+	results := updateResults(updateConfig(decodeUpdateParams(t, `{
+		"dns": {"enable": true, "nameserver": ["bad://192.0.2.53"]},
+		"allow-lan": true
+	}`)))
+	if result := results["dns"]; result == nil || result.Success || result.Error == "" {
+		t.Fatalf("dns: %+v", result)
+	}
+	if result := results["allow-lan"]; result == nil || !result.Success {
+		t.Fatalf("allow-lan: %+v", result)
+	}
+	if currentConfig.DNS != dns || lastGoodSetupParams.Config.DNS.Enable {
+		t.Fatal("a dns update that failed to parse was applied")
+	}
+	if !lastGoodSetupParams.Config.AllowLan {
+		t.Fatal("allow-lan not kept for reloads")
+	}
+}
+
+func TestUpdateConfigPartialTun(t *testing.T) {
+	setupUpdateTest(t)
+	if results := updateResults(updateConfig(decodeUpdateParams(t, `{"tun": {"mtu": 1400, "device": "utun-test"}}`))); !results["tun"].Success {
+		t.Fatalf("tun: %+v", results["tun"])
+	}
+	stack := currentConfig.General.Tun.Stack
+	if results := updateResults(updateConfig(decodeUpdateParams(t, `{"tun": {"enable": true}}`))); !results["tun"].Success {
+		t.Fatalf("tun: %+v", results["tun"])
+	}
+	tun := currentConfig.General.Tun
+	if !tun.Enable || tun.MTU != 1400 || tun.Device != "utun-test" || tun.Stack != stack {
+		t.Fatalf("enable only update reset other fields: %+v", tun)
+	}
+	raw := lastGoodSetupParams.Config.Tun
+	if !raw.Enable || raw.MTU != 1400 || raw.Device != "utun-test" {
+		t.Fatalf("tun update not kept for reloads: %+v", raw)
+	}
+}
+
+func TestUpdateConfigInvalidTun(t *testing.T) {
+	setupUpdateTest(t)
+	for _, data := range []string{
+		`{"tun": {"enable": true, "mtu": 100}}`,
+		`{"tun": {"enable": true, "dns-hijack": ["any:dns"]}}`,
+		`{"tun": {"enable": true, "dns-hijack": ["udp://198.18.0.2"]}}`,
+		`{"tun": {"enable": true, "include-uid-range": ["1000"]}}`,
+		`{"tun": {"enable": true, "exclude-uid-range": ["2000:1000"]}}`,
+	} {
+		tun := currentConfig.General.Tun
+		result := updateResults(updateConfig(decodeUpdateParams(t, data)))["tun"]
+		if result == nil || result.Success || result.Error == "" {
+			t.Errorf("%s: %+v", data, result)
+		}
+		if current := currentConfig.General.Tun; current.Enable != tun.Enable || current.MTU != tun.MTU {
+			t.Errorf("%s: an invalid tun update was applied", data)
+		}
+		if lastGoodSetupParams.Config.Tun.Enable {
+			t.Errorf("%s: an invalid tun update was kept for reloads", data)
+		}
+	}
+}
+
+func TestTunSchemaPatch(t *testing.T) {
+	schema := &tunSchema{}
+	if err := json.Unmarshal([]byte(`{
+		"enable": true, "device": "utun-test", "stack": "gvisor", "dns-hijack": ["any:53"],
+		"auto-route": true, "auto-detect-interface": true, "strict-route": true, "mtu": 1400,
+		"route-address": ["10.0.0.0/8"], "route-exclude-address": ["192.168.0.0/16"],
+		"include-interface": ["eth0"], "exclude-interface": ["eth1"],
+		"include-uid": [1000], "include-uid-range": ["1000:2000"],
+		"exclude-uid": [0], "exclude-uid-range": ["0:99"],
+		"include-package": ["com.example.a"], "exclude-package": ["com.example.b"]
+	}`), schema); err != nil {
+		t.Fatal(err)
+	}
+	tun := LC.Tun{}
+	raw := config.RawTun{}
+	schema.patch(&tun)
+	schema.patch(&raw)
+	source := reflect.ValueOf(schema).Elem()
+	for i := 0; i < source.NumField(); i++ {
+		name := source.Type().Field(i).Name
+		want := source.Field(i).Elem().Interface()
+		if got := reflect.ValueOf(tun).FieldByName(name).Interface(); !reflect.DeepEqual(got, want) {
+			t.Errorf("LC.Tun.%s = %v, want %v", name, got, want)
+		}
+		if got := reflect.ValueOf(raw).FieldByName(name).Interface(); !reflect.DeepEqual(got, want) {
+			t.Errorf("config.RawTun.%s = %v, want %v", name, got, want)
+		}
+	}
+
+	// unset fields are left as they are
+	tun = LC.Tun{Device: "keep", MTU: 9000}
+	(&tunSchema{Enable: &[]bool{true}[0]}).patch(&tun)
+	if !tun.Enable || tun.Device != "keep" || tun.MTU != 9000 {
+		t.Fatalf("partial patch = %+v", tun)
+	}
+}
+
+func TestTunAddressDesktop(t *testing.T) {
+	setupUpdateTest(t)
+	t.Cleanup(func() {
+		_ = updateState(`{"tun-address":null}`)
+	})
+	inet4 := currentConfig.General.Tun.Inet4Address
+	if tun := withTunAddress(currentConfig.General.Tun, state.Get()); !reflect.DeepEqual(tun.Inet4Address, inet4) {
+		t.Fatalf("config prefixes replaced without a state address: %v", tun.Inet4Address)
+	}
+
+	if err := updateState(`{"tun-address":{"ipv4-address":"10.10.0.0/30","gateway":"10.10.0.2","mtu":1400}}`); err != nil {
+		t.Fatal(err)
+	}
+	tun := withTunAddress(currentConfig.General.Tun, state.Get())
+	if want := []netip.Prefix{netip.MustParsePrefix("10.10.0.2/30")}; !reflect.DeepEqual(tun.Inet4Address, want) {
+		t.Fatalf("inet4-address = %v, want %v", tun.Inet4Address, want)
+	}
+	if tun.MTU != 1400 {
+		t.Fatalf("mtu = %d", tun.MTU)
+	}
+
+	for _, data := range []string{
+		`{"tun-address":{"ipv4-address":"10.10.0.0/30","gateway":"10.20.0.1"}}`,
+		`{"tun-address":{"ipv4-address":"fd00::/64"}}`,
+	} {
+		if err := updateState(data); err == nil {
+			t.Errorf("%s: expected an error", data)
+		}
+	}
+	result := updateResults(updateConfig(decodeUpdateParams(t, `{"tun": {"route-exclude-address": ["10.10.0.0/16"]}}`)))["tun"]
+	if result == nil || result.Success {
+		t.Fatalf("route-exclude-address over the tun address: %+v", result)
+	}
+	if results := updateResults(updateConfig(decodeUpdateParams(t, `{"tun": {"route-exclude-address": ["10.20.0.0/16"]}}`))); !results["tun"].Success {
+		t.Fatalf("tun: %+v", results["tun"])
+	}
+	if err := updateState(`{"tun-address":{"ipv4-address":"10.20.0.0/30","gateway":null}}`); err == nil {
+		t.Fatal("a tun address inside route-exclude-address passed")
+	}
+	if current := state.Get().TunAddress.Ipv4Address; current != "10.10.0.0/30" {
+		t.Fatalf("a rejected tun address was applied: %s", current)
+	}
+}
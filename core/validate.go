@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/constant"
+	"gopkg.in/yaml.v3"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Severity string
+
+const (
+	ErrorSeverity   Severity = "error"
+	WarningSeverity Severity = "warning"
+)
+
+type Diagnostic struct {
+	Severity Severity `json:"severity"`
+	Path     string   `json:"path"`
+	Line     int      `json:"line"`
+	Column   int      `json:"column"`
+	Message  string   `json:"message"`
+}
+
+type ValidateResult struct {
+	Valid       bool          `json:"valid"`
+	Diagnostics []*Diagnostic `json:"diagnostics"`
+}
+
+var builtinProxies = map[string]bool{
+	"DIRECT":      true,
+	"REJECT":      true,
+	"REJECT-DROP": true,
+	"PASS":        true,
+	"COMPATIBLE":  true,
+	"GLOBAL":      true,
+}
+
+var (
+	yamlLineRegexp  = regexp.MustCompile(`line (\d+)`)
+	parseErrorPaths = []struct {
+		regexp *regexp.Regexp
+		path   func(match []string) string
+	}{
+		{regexp.MustCompile(`^rules\[(\d+)\]`), func(m []string) string { return "rules[" + m[1] + "]" }},
+		{regexp.MustCompile(`^sub-rules\[([^\]]+)\]\[(\d+)\]`), func(m []string) string { return "sub-rules." + m[1] + "[" + m[2] + "]" }},
+		{regexp.MustCompile(`^proxy group\[(\d+)\]`), func(m []string) string { return "proxy-groups[" + m[1] + "]" }},
+		{regexp.MustCompile(`^proxy (\d+):`), func(m []string) string { return "proxies[" + m[1] + "]" }},
+		{regexp.MustCompile(`^parse proxy provider (\S+) error`), func(m []string) string { return "proxy-providers." + m[1] }},
+		{regexp.MustCompile(`^DNS NameServer\[(\d+)\]`), func(m []string) string { return "dns.nameserver[" + m[1] + "]" }},
+	}
+)
+
+type configValidator struct {
+	root        *yaml.Node
+	diagnostics []*Diagnostic
+}
+
+// lookup resolves a path like "proxy-groups[1].proxies[2]" in the yaml tree.
+func (v *configValidator) lookup(path string) *yaml.Node {
+	node := v.root
+	if node == nil {
+		return nil
+	}
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, segment := range strings.Split(path, ".") {
+		key := segment
+		var indexes []int
+		if i := strings.Index(segment, "["); i != -1 {
+			key = segment[:i]
+			for _, part := range strings.Split(segment[i+1:len(segment)-1], "][") {
+				index, err := strconv.Atoi(part)
+				if err != nil {
+					return node
+				}
+				indexes = append(indexes, index)
+			}
+		}
+		if key != "" {
+			next := mappingValue(node, key)
+			if next == nil {
+				return node
+			}
+			node = next
+		}
+		for _, index := range indexes {
+			if node.Kind != yaml.SequenceNode || index >= len(node.Content) {
+				return node
+			}
+			node = node.Content[index]
+		}
+	}
+	return node
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func (v *configValidator) add(severity Severity, path string, message string) {
+	diagnostic := &Diagnostic{
+		Severity: severity,
+		Path:     path,
+		Message:  message,
+	}
+	if path != "" {
+		if node := v.lookup(path); node != nil {
+			diagnostic.Line = node.Line
+			diagnostic.Column = node.Column
+		}
+	}
+	v.diagnostics = append(v.diagnostics, diagnostic)
+}
+
+func (v *configValidator) hasError(path string) bool {
+	for _, diagnostic := range v.diagnostics {
+		if diagnostic.Severity == ErrorSeverity && diagnostic.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *configValidator) checkProxies(rawConfig *config.RawConfig) map[string]bool {
+	names := map[string]bool{}
+	for name := range builtinProxies {
+		names[name] = true
+	}
+	for index, mapping := range rawConfig.Proxy {
+		path := fmt.Sprintf("proxies[%d]", index)
+		proxy, err := adapter.ParseProxy(mapping)
+		if err != nil {
+			v.add(ErrorSeverity, path, err.Error())
+			if name, ok := mapping["name"].(string); ok {
+				names[name] = true
+			}
+			continue
+		}
+		if names[proxy.Name()] {
+			v.add(ErrorSeverity, path, fmt.Sprintf("proxy %s is the duplicate name", proxy.Name()))
+		}
+		names[proxy.Name()] = true
+	}
+	for index, mapping := range rawConfig.ProxyGroup {
+		name, ok := mapping["name"].(string)
+		if !ok || name == "" {
+			v.add(ErrorSeverity, fmt.Sprintf("proxy-groups[%d]", index), "missing name")
+			continue
+		}
+		names[name] = true
+	}
+	return names
+}
+
+func (v *configValidator) checkGroups(rawConfig *config.RawConfig, names map[string]bool) {
+	for index, mapping := range rawConfig.ProxyGroup {
+		if proxies, ok := mapping["proxies"].([]any); ok {
+			for i, item := range proxies {
+				name, _ := item.(string)
+				if !names[name] {
+					v.add(WarningSeverity, fmt.Sprintf("proxy-groups[%d].proxies[%d]", index, i), fmt.Sprintf("proxy %s not found", name))
+				}
+			}
+		}
+		if uses, ok := mapping["use"].([]any); ok {
+			for i, item := range uses {
+				name, _ := item.(string)
+				if _, exist := rawConfig.ProxyProvider[name]; !exist {
+					v.add(WarningSeverity, fmt.Sprintf("proxy-groups[%d].use[%d]", index, i), fmt.Sprintf("proxy provider %s not found", name))
+				}
+			}
+		}
+	}
+}
+
+func (v *configValidator) checkRules(rawConfig *config.RawConfig, names map[string]bool) {
+	subRules := map[string][]constant.Rule{}
+	for name := range rawConfig.SubRules {
+		subRules[name] = []constant.Rule{}
+	}
+	hasProxy := func(name string) bool {
+		return names[name]
+	}
+	hasRuleProvider := func(name string) bool {
+		_, ok := rawConfig.RuleProvider[name]
+		return ok
+	}
+	check := func(prefix string, lines []string) {
+		seen := map[string]int{}
+		matchIndex := -1
+		for index, line := range lines {
+			path := fmt.Sprintf("%s[%d]", prefix, index)
+			rule, err := buildRule(line, hasProxy, subRules, hasRuleProvider)
+			if err != nil {
+				v.add(ErrorSeverity, path, fmt.Sprintf("[%s] %s", line, err.Error()))
+				continue
+			}
+			if matchIndex != -1 {
+				v.add(WarningSeverity, path, fmt.Sprintf("unreachable rule after MATCH at %s[%d]", prefix, matchIndex))
+				continue
+			}
+			if rule.RuleType() == constant.MATCH {
+				matchIndex = index
+				continue
+			}
+			// params such as no-resolve change what a rule matches
+			_, _, _, params, _ := splitRuleLine(line)
+			key := strings.Join(append([]string{rule.RuleType().String(), rule.Payload()}, params...), ",")
+			if first, ok := seen[key]; ok {
+				v.add(WarningSeverity, path, fmt.Sprintf("unreachable rule shadowed by %s[%d]", prefix, first))
+				continue
+			}
+			seen[key] = index
+		}
+	}
+	check("rules", rawConfig.Rule)
+	subRuleNames := make([]string, 0, len(rawConfig.SubRules))
+	for name := range rawConfig.SubRules {
+		subRuleNames = append(subRuleNames, name)
+	}
+	sort.Strings(subRuleNames)
+	for _, name := range subRuleNames {
+		check("sub-rules."+name, rawConfig.SubRules[name])
+	}
+}
+
+func (v *configValidator) addParseError(err error) {
+	message := err.Error()
+	for _, item := range parseErrorPaths {
+		if match := item.regexp.FindStringSubmatch(message); match != nil {
+			path := item.path(match)
+			if !v.hasError(path) {
+				v.add(ErrorSeverity, path, message)
+			}
+			return
+		}
+	}
+	v.add(ErrorSeverity, "", message)
+}
+
+// diagnoseConfig parses bytes completely without applying it and collects
+// every problem found instead of stopping at the first one. The parse runs
+// under runLock.
+func diagnoseConfig(bytes []byte) *ValidateResult {
+	v := &configValidator{
+		diagnostics: []*Diagnostic{},
+	}
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(bytes, root); err != nil {
+		diagnostic := &Diagnostic{
+			Severity: ErrorSeverity,
+			Message:  err.Error(),
+		}
+		if match := yamlLineRegexp.FindStringSubmatch(err.Error()); match != nil {
+			diagnostic.Line, _ = strconv.Atoi(match[1])
+		}
+		v.diagnostics = append(v.diagnostics, diagnostic)
+		return &ValidateResult{Diagnostics: v.diagnostics}
+	}
+	v.root = root
+	rawConfig, err := config.UnmarshalRawConfig(bytes)
+	if err != nil {
+		var typeError *yaml.TypeError
+		if errors.As(err, &typeError) {
+			for _, message := range typeError.Errors {
+				diagnostic := &Diagnostic{
+					Severity: ErrorSeverity,
+					Message:  message,
+				}
+				if match := yamlLineRegexp.FindStringSubmatch(message); match != nil {
+					diagnostic.Line, _ = strconv.Atoi(match[1])
+				}
+				v.diagnostics = append(v.diagnostics, diagnostic)
+			}
+		} else {
+			v.add(ErrorSeverity, "", err.Error())
+		}
+		return &ValidateResult{Diagnostics: v.diagnostics}
+	}
+	names := v.checkProxies(rawConfig)
+	v.checkGroups(rawConfig, names)
+	// building rules and parsing load geodata and switch the general
+	// settings for a while, which must not interleave with a running setup
+	runLock.Lock()
+	v.checkRules(rawConfig, names)
+	_, err = config.ParseRawConfig(rawConfig)
+	runLock.Unlock()
+	if err != nil {
+		v.addParseError(err)
+	}
+	result := &ValidateResult{
+		Valid:       true,
+		Diagnostics: v.diagnostics,
+	}
+	for _, diagnostic := range v.diagnostics {
+		if diagnostic.Severity == ErrorSeverity {
+			result.Valid = false
+			break
+		}
+	}
+	return result
+}
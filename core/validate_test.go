@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func findDiagnostic(result *ValidateResult, severity Severity, path string) *Diagnostic {
+	for _, diagnostic := range result.Diagnostics {
+		if diagnostic.Severity == severity && diagnostic.Path == path {
+			return diagnostic
+		}
+	}
+	return nil
+}
+
+func TestDiagnoseConfig(t *testing.T) {
+	useTestHomeDir(t)
+	result := diagnoseConfig([]byte(`
+proxies:
+  - {name: proxy, type: socks5, server: 127.0.0.1, port: 1080}
+rules:
+  - DOMAIN,example.com,proxy
+  - DOMAIN,example.com,DIRECT
+  - DOMAIN,example.org,missing
+  - IP-CIDR,192.0.2.0/24,proxy
+  - IP-CIDR,192.0.2.0/24,proxy,no-resolve
+  - MATCH,DIRECT
+  - DOMAIN,example.net,DIRECT
+`))
+	if result.Valid {
+		t.Fatal("a rule with a missing proxy passed")
+	}
+	for _, want := range []struct {
+		severity Severity
+		path     string
+	}{
+		{WarningSeverity, "rules[1]"},
+		{ErrorSeverity, "rules[2]"},
+		{WarningSeverity, "rules[6]"},
+	} {
+		if findDiagnostic(result, want.severity, want.path) == nil {
+			t.Errorf("no %s at %s in %+v", want.severity, want.path, result.Diagnostics)
+		}
+	}
+	// rules differing in params match differently
+	if diagnostic := findDiagnostic(result, WarningSeverity, "rules[4]"); diagnostic != nil {
+		t.Errorf("unexpected %+v", diagnostic)
+	}
+
+	if result = diagnoseConfig([]byte("rules: [MATCH,DIRECT")); result.Valid || len(result.Diagnostics) != 1 || result.Diagnostics[0].Line == 0 {
+		t.Fatalf("yaml error = %+v", result)
+	}
+	if result = diagnoseConfig([]byte("rules:\n  - MATCH,DIRECT\n")); !result.Valid {
+		t.Fatalf("valid config = %+v", result)
+	}
+}
+
+func TestDiagnoseConfigWaitsForRunLock(t *testing.T) {
+	useTestHomeDir(t)
+	runLock.Lock()
+	done := make(chan *ValidateResult)
+	go func() {
+		done <- diagnoseConfig([]byte("rules:\n  - MATCH,DIRECT\n"))
+	}()
+	select {
+	case <-done:
+		runLock.Unlock()
+		t.Fatal("parsed while runLock was held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	runLock.Unlock()
+	if result := <-done; !result.Valid {
+		t.Fatalf("valid config = %+v", result)
+	}
+}
@@ -116,6 +116,7 @@ _$AndroidVpnOptionsImpl _$$AndroidVpnOptionsImplFromJson(
               .toList() ??
           const [],
       dnsServerAddress: json['dnsServerAddress'] as String,
+      mtu: (json['mtu'] as num?)?.toInt() ?? 9000,
     );
 
 Map<String, dynamic> _$$AndroidVpnOptionsImplToJson(
@@ -131,6 +132,7 @@ Map<String, dynamic> _$$AndroidVpnOptionsImplToJson(
       'ipv6Address': instance.ipv6Address,
       'routeAddress': instance.routeAddress,
       'dnsServerAddress': instance.dnsServerAddress,
+      'mtu': instance.mtu,
     };
 
 _$InitParamsImpl _$$InitParamsImplFromJson(Map<String, dynamic> json) =>